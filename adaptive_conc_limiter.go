@@ -0,0 +1,118 @@
+package multilimiter
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+)
+
+// A concurrency limiter that finds its own limit from the round trip time and drops
+// reported through Slot.ReleaseWithResult()
+// BasicLimiter reports every function it runs so this can be used through ConcLimitOption as is
+type AdaptiveConcLimiter struct {
+	inner     *BasicConcLimiter
+	algorithm LimitAlgorithm
+	min, max  int
+	mu        sync.Mutex
+	limit     float64
+}
+
+var _ ConcLimiter = (*AdaptiveConcLimiter)(nil)
+
+// Creates a limiter starting at initial that adjusts within min and max using algorithm
+// min is raised to 1 and max to min if they are out of order
+func NewAdaptiveConcLimiter(initial, min, max int, algorithm LimitAlgorithm) *AdaptiveConcLimiter {
+	if min < 1 {
+		min = 1
+	}
+	if max < min {
+		max = min
+	}
+	if initial < min {
+		initial = min
+	}
+	if initial > max {
+		initial = max
+	}
+
+	return &AdaptiveConcLimiter{
+		inner:     NewConcLimiter(initial),
+		algorithm: algorithm,
+		min:       min,
+		max:       max,
+		limit:     float64(initial),
+	}
+}
+
+func (me *AdaptiveConcLimiter) Acquire(ctx context.Context) (Slot, error) {
+	return me.AcquireN(ctx, 1)
+}
+
+func (me *AdaptiveConcLimiter) AcquireN(ctx context.Context, n int) (Slot, error) {
+	slot, err := me.inner.AcquireN(ctx, n)
+	if err != nil {
+		return nil, err
+	}
+	return &adaptiveSlot{Slot: slot, limiter: me}, nil
+}
+
+func (me *AdaptiveConcLimiter) TryAcquire() (Slot, bool) {
+	slot, ok := me.inner.TryAcquire()
+	if !ok {
+		return nil, false
+	}
+	return &adaptiveSlot{Slot: slot, limiter: me}, true
+}
+
+func (me *AdaptiveConcLimiter) Cancel() {
+	me.inner.Cancel()
+}
+
+// The current limit
+func (me *AdaptiveConcLimiter) Concurrency() int {
+	return me.inner.Concurrency()
+}
+
+// The number of slots currently held
+func (me *AdaptiveConcLimiter) InUse() int {
+	return me.inner.InUse()
+}
+
+func (me *AdaptiveConcLimiter) Wait() {
+	me.inner.Wait()
+}
+
+// Feeds a sample to the algorithm and applies the resulting limit
+func (me *AdaptiveConcLimiter) update(rtt time.Duration, dropped bool) {
+	inflight := me.inner.InUse()
+
+	me.mu.Lock()
+	defer me.mu.Unlock()
+
+	limit := me.algorithm.Update(me.limit, inflight, rtt, dropped)
+	me.limit = math.Max(float64(me.min), math.Min(float64(me.max), limit))
+
+	if size := int(me.limit); size != me.inner.Concurrency() {
+		me.inner.SetConcurrency(size)
+	}
+}
+
+// A slot that reports its result to the AdaptiveConcLimiter
+type adaptiveSlot struct {
+	Slot
+	limiter *AdaptiveConcLimiter
+	once    sync.Once
+}
+
+// Releases the slot without providing a sample
+func (me *adaptiveSlot) Release() {
+	me.once.Do(me.Slot.Release)
+}
+
+func (me *adaptiveSlot) ReleaseWithResult(rtt time.Duration, dropped bool) {
+	me.once.Do(func() {
+		me.limiter.update(rtt, dropped)
+		me.Slot.Release()
+	})
+}
@@ -0,0 +1,96 @@
+package multilimiter_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/jrboelens/multilimiter"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestAdaptiveConcLimiterSpec(t *testing.T) {
+
+	timeout := 20 * time.Millisecond
+	rtt := 10 * time.Millisecond
+
+	Convey("AdaptiveConcLimiter tests ", t, func() {
+
+		Convey("the initial limit is kept within min and max", func() {
+			lim := multilimiter.NewAdaptiveConcLimiter(100, 2, 10, &multilimiter.AIMDLimit{})
+			So(lim.Concurrency(), ShouldEqual, 10)
+
+			lim = multilimiter.NewAdaptiveConcLimiter(0, 2, 10, &multilimiter.AIMDLimit{})
+			So(lim.Concurrency(), ShouldEqual, 2)
+		})
+
+		Convey("successful samples raise the limit up to max", func() {
+			lim := multilimiter.NewAdaptiveConcLimiter(2, 1, 4, &multilimiter.AIMDLimit{})
+
+			// keep the limit fully used so the algorithm sees demand
+			for i := 0; i < 5; i++ {
+				var slots []multilimiter.Slot
+				for j := 0; j < lim.Concurrency(); j++ {
+					slot, err := lim.Acquire(Context(timeout))
+					So(err, ShouldBeNil)
+					slots = append(slots, slot)
+				}
+				for _, slot := range slots {
+					slot.ReleaseWithResult(rtt, false)
+				}
+			}
+			So(lim.Concurrency(), ShouldEqual, 4)
+		})
+
+		Convey("dropped samples lower the limit down to min", func() {
+			lim := multilimiter.NewAdaptiveConcLimiter(10, 3, 20, &multilimiter.AIMDLimit{BackoffRatio: 0.5})
+
+			for i := 0; i < 10; i++ {
+				slot, err := lim.Acquire(Context(timeout))
+				So(err, ShouldBeNil)
+				slot.ReleaseWithResult(rtt, true)
+			}
+			So(lim.Concurrency(), ShouldEqual, 3)
+		})
+
+		Convey("Release does not provide a sample", func() {
+			lim := multilimiter.NewAdaptiveConcLimiter(2, 1, 4, &multilimiter.AIMDLimit{})
+			slot, _ := lim.Acquire(Context(timeout))
+			slot.Release()
+			slot.ReleaseWithResult(rtt, true)
+
+			So(lim.Concurrency(), ShouldEqual, 2)
+			So(lim.InUse(), ShouldEqual, 0)
+		})
+
+		Convey("plugs into BasicLimiter", func() {
+			concLim := multilimiter.NewAdaptiveConcLimiter(8, 1, 8, &multilimiter.AIMDLimit{BackoffRatio: 0.5})
+			lim := multilimiter.NewLimiter(
+				&multilimiter.ConcLimitOption{Limiter: concLim},
+				&multilimiter.RateLimitOption{Limiter: multilimiter.NewRateLimiter(0)},
+				&multilimiter.PanicOption{Mode: multilimiter.PanicLog},
+				&multilimiter.LogOption{Logger: discardLogger{}},
+			)
+			defer lim.Stop()
+
+			Convey("functions can report that their work was dropped", func() {
+				err := lim.Do(Context(timeout), func(ctx context.Context) error {
+					multilimiter.ReportOutcome(ctx, multilimiter.OutcomeDropped)
+					return nil
+				})
+				So(err, ShouldBeNil)
+				So(concLim.Concurrency(), ShouldEqual, 4)
+			})
+
+			Convey("panics count as dropped", func() {
+				lim.Execute(Context(timeout), func(context.Context) { panic("boom") })
+				lim.Wait()
+				So(concLim.Concurrency(), ShouldEqual, 4)
+			})
+		})
+	})
+}
+
+type discardLogger struct{}
+
+func (discardLogger) Printf(string, ...interface{}) {}
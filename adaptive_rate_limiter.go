@@ -0,0 +1,190 @@
+package multilimiter
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+)
+
+// Controls how an AdaptiveRateLimiter reacts to outcomes
+// Zero values use the defaults
+type AdaptiveRatePolicy struct {
+	// How much the rate grows over each second of successful calls; defaults to 1
+	Increase float64
+	// Multiplies the rate when a call is throttled; defaults to 0.5
+	Decay float64
+	// Throttled calls within Cooldown of the last decrease are ignored so that a burst of
+	// rejections from calls that were already in flight only counts once; defaults to one second
+	Cooldown time.Duration
+}
+
+// A rate limiter that probes for the rate a downstream service will accept
+// The rate grows slowly while calls succeed and is cut multiplicatively when they are throttled
+// BasicLimiter reports outcomes automatically; functions report throttling with ReportOutcome()
+// or through an OutcomeOption classifier
+type AdaptiveRateLimiter struct {
+	bucket         *BasicRateLimiter
+	floor, ceiling float64
+	increase       float64
+	decay          float64
+	cooldown       time.Duration
+	mu             sync.Mutex
+	// the rate the limiter is aiming for; only applied once it moves far enough
+	target       float64
+	lastDecrease time.Time
+}
+
+var _ RateLimiter = (*AdaptiveRateLimiter)(nil)
+var _ OutcomeListener = (*AdaptiveRateLimiter)(nil)
+
+// The relative change needed before a growing target is applied to the bucket
+// keeping callers from being rescheduled after every success
+const adaptiveRateStep = 0.01
+
+// Creates a limiter starting at initial that adjusts between floor and ceiling
+// floor must be positive; values <= 0 use DEFAULT_RATE
+// A nil policy uses the defaults
+// An error matching InvalidBucketConfig is returned if the rates or opts are invalid
+func NewAdaptiveRateLimiter(initial, floor, ceiling float64, policy *AdaptiveRatePolicy, opts ...BucketOption) (*AdaptiveRateLimiter, error) {
+	if floor <= 0 {
+		floor = DEFAULT_RATE
+	}
+	if ceiling < floor {
+		ceiling = floor
+	}
+	initial = math.Max(floor, math.Min(ceiling, initial))
+
+	if policy == nil {
+		policy = &AdaptiveRatePolicy{}
+	}
+	increase := policy.Increase
+	if increase <= 0 {
+		increase = 1
+	}
+	decay := policy.Decay
+	if decay <= 0 || decay >= 1 {
+		decay = 0.5
+	}
+	cooldown := policy.Cooldown
+	if cooldown <= 0 {
+		cooldown = time.Second
+	}
+
+	bucket, err := NewBasicRateLimiter(initial, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	return &AdaptiveRateLimiter{
+		bucket:   bucket,
+		floor:    floor,
+		ceiling:  ceiling,
+		increase: increase,
+		decay:    decay,
+		cooldown: cooldown,
+		target:   initial,
+	}, nil
+}
+
+func (me *AdaptiveRateLimiter) Wait(ctx context.Context) error {
+	return me.bucket.Wait(ctx)
+}
+
+func (me *AdaptiveRateLimiter) WaitN(ctx context.Context, tokens int64) error {
+	return me.bucket.WaitN(ctx, tokens)
+}
+
+func (me *AdaptiveRateLimiter) Allow() bool {
+	return me.bucket.Allow()
+}
+
+func (me *AdaptiveRateLimiter) Reserve(tokens int64) Reservation {
+	return me.bucket.Reserve(tokens)
+}
+
+// The rate currently applied, which may trail the target by up to adaptiveRateStep while it grows
+func (me *AdaptiveRateLimiter) Rate() float64 {
+	return me.bucket.Rate()
+}
+
+func (me *AdaptiveRateLimiter) Cancel() {
+	me.bucket.Cancel()
+}
+
+func (me *AdaptiveRateLimiter) Available() int64 {
+	return me.bucket.Available()
+}
+
+// Moves the rate, kept between floor and ceiling, and carries on adapting from there
+// An error matching InvalidBucketConfig is returned, and the rate left alone, if rate isn't finite
+func (me *AdaptiveRateLimiter) SetRate(rate float64) error {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+
+	rate = math.Max(me.floor, math.Min(me.ceiling, rate))
+	if err := me.bucket.SetRate(rate); err != nil {
+		return err
+	}
+	me.target = rate
+	return nil
+}
+
+// Changes how many tokens can accumulate
+// if capacity is < 1, DEFAULT_BURST will be used
+func (me *AdaptiveRateLimiter) SetBurst(capacity int64) error {
+	return me.bucket.SetBurst(capacity)
+}
+
+// The maximum number of tokens the bucket can hold
+func (me *AdaptiveRateLimiter) Capacity() int64 {
+	return me.bucket.Capacity()
+}
+
+// Adjusts the rate from the outcome of a call
+func (me *AdaptiveRateLimiter) OnOutcome(outcome Outcome) {
+	switch outcome {
+	case OutcomeSuccess:
+		me.succeeded()
+	case OutcomeThrottled:
+		me.throttled()
+	}
+}
+
+// Reports a successful call
+func (me *AdaptiveRateLimiter) succeeded() {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+
+	// growing by increase/target per call adds roughly increase per second at the current rate
+	me.target = math.Min(me.ceiling, me.target+me.increase/me.target)
+
+	if current := me.Rate(); me.target >= current*(1+adaptiveRateStep) || (me.target == me.ceiling && current != me.ceiling) {
+		me.bucket.SetRate(me.target)
+	}
+}
+
+// Reports a throttled call
+func (me *AdaptiveRateLimiter) throttled() {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(me.lastDecrease) < me.cooldown {
+		return
+	}
+	me.lastDecrease = now
+
+	me.target = math.Max(me.floor, me.target*me.decay)
+	me.bucket.SetRate(me.target)
+}
+
+// The lowest rate the limiter will drop to
+func (me *AdaptiveRateLimiter) Floor() float64 {
+	return me.floor
+}
+
+// The highest rate the limiter will climb to
+func (me *AdaptiveRateLimiter) Ceiling() float64 {
+	return me.ceiling
+}
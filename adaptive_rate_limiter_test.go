@@ -0,0 +1,112 @@
+package multilimiter_test
+
+import (
+	"context"
+	"errors"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/jrboelens/multilimiter"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestAdaptiveRateLimiterSpec(t *testing.T) {
+
+	timeout := 20 * time.Millisecond
+	policy := &multilimiter.AdaptiveRatePolicy{Decay: 0.5, Cooldown: time.Hour}
+
+	Convey("AdaptiveRateLimiter tests ", t, func() {
+
+		Convey("the initial rate is kept within floor and ceiling", func() {
+			lim := NewAdaptiveRateLimiter(1000, 1, 100, nil)
+			So(lim.Rate(), ShouldEqual, 100)
+
+			lim = NewAdaptiveRateLimiter(0, 5, 100, nil)
+			So(lim.Rate(), ShouldEqual, 5)
+		})
+
+		Convey("throttling cuts the rate by the decay down to the floor", func() {
+			lim := NewAdaptiveRateLimiter(100, 30, 100, &multilimiter.AdaptiveRatePolicy{Decay: 0.5, Cooldown: time.Nanosecond})
+
+			lim.OnOutcome(multilimiter.OutcomeThrottled)
+			So(lim.Rate(), ShouldEqual, 50)
+
+			time.Sleep(time.Millisecond)
+			lim.OnOutcome(multilimiter.OutcomeThrottled)
+			So(lim.Rate(), ShouldEqual, 30)
+		})
+
+		Convey("throttling within the cooldown only counts once", func() {
+			lim := NewAdaptiveRateLimiter(100, 1, 100, policy)
+
+			lim.OnOutcome(multilimiter.OutcomeThrottled)
+			lim.OnOutcome(multilimiter.OutcomeThrottled)
+			So(lim.Rate(), ShouldEqual, 50)
+		})
+
+		Convey("successes raise the rate slowly up to the ceiling", func() {
+			lim := NewAdaptiveRateLimiter(10, 1, 12, &multilimiter.AdaptiveRatePolicy{Increase: 10})
+
+			lim.OnOutcome(multilimiter.OutcomeSuccess)
+			So(lim.Rate(), ShouldBeGreaterThan, 10)
+			So(lim.Rate(), ShouldBeLessThan, 12)
+
+			for i := 0; i < 100; i++ {
+				lim.OnOutcome(multilimiter.OutcomeSuccess)
+			}
+			So(lim.Rate(), ShouldEqual, 12)
+		})
+
+		Convey("SetRate moves the target that adaptation continues from", func() {
+			lim := NewAdaptiveRateLimiter(10, 1, 100, &multilimiter.AdaptiveRatePolicy{Decay: 0.5, Cooldown: time.Nanosecond})
+
+			So(lim.SetRate(60), ShouldBeNil)
+			So(lim.Rate(), ShouldEqual, 60)
+			lim.OnOutcome(multilimiter.OutcomeThrottled)
+			So(lim.Rate(), ShouldEqual, 30)
+
+			So(lim.SetRate(1000), ShouldBeNil)
+			So(lim.Rate(), ShouldEqual, 100)
+			So(lim.SetRate(math.NaN()), ShouldMatchError, multilimiter.InvalidBucketConfig)
+			So(lim.Rate(), ShouldEqual, 100)
+		})
+
+		Convey("dropped outcomes do not change the rate", func() {
+			lim := NewAdaptiveRateLimiter(10, 1, 100, policy)
+			lim.OnOutcome(multilimiter.OutcomeDropped)
+			So(lim.Rate(), ShouldEqual, 10)
+		})
+
+		Convey("plugs into BasicLimiter", func() {
+			throttledErr := errors.New("429 Too Many Requests")
+			rateLim := NewAdaptiveRateLimiter(100, 1, 100, policy, &multilimiter.BurstOption{Capacity: 10})
+			classifier := func(err error) multilimiter.Outcome {
+				if err == throttledErr {
+					return multilimiter.OutcomeThrottled
+				}
+				return multilimiter.OutcomeSuccess
+			}
+			lim := multilimiter.NewLimiter(
+				&multilimiter.RateLimitOption{Limiter: rateLim},
+				&multilimiter.OutcomeOption{Classifier: classifier},
+			)
+			defer lim.Stop()
+
+			Convey("functions can report throttling", func() {
+				err := lim.Execute(Context(timeout), func(ctx context.Context) {
+					multilimiter.ReportOutcome(ctx, multilimiter.OutcomeThrottled)
+				})
+				So(err, ShouldBeNil)
+				lim.Wait()
+				So(rateLim.Rate(), ShouldEqual, 50)
+			})
+
+			Convey("returned errors are classified", func() {
+				err := lim.Do(Context(timeout), func(context.Context) error { return throttledErr })
+				So(err, ShouldEqual, throttledErr)
+				So(rateLim.Rate(), ShouldEqual, 50)
+			})
+		})
+	})
+}
@@ -0,0 +1,243 @@
+package multilimiter
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"time"
+)
+
+// A token bucket that supports returning tokens which were reserved but never used
+// Tokens accrue continuously at rate per second or, when a quantum is set, quantum at a time, up to capacity
+// The balance goes negative while callers wait on tokens that haven't accrued yet
+// A rate <= 0 means the bucket never runs out of tokens
+type tokenBucket struct {
+	mu       sync.Mutex
+	rate     float64
+	capacity int64
+	quantum  int64
+	// the balance as of updated; fractional while filling continuously
+	tokens  float64
+	updated time.Time
+	// closed and replaced whenever the rate changes while callers are owed tokens
+	changed chan struct{}
+}
+
+// Creates a full bucket that fills at rate tokens per second
+// if quantum is < 1 tokens accrue continuously
+func newTokenBucket(now time.Time, rate float64, capacity, quantum int64) (*tokenBucket, error) {
+	if err := validateBucket(rate, capacity, quantum); err != nil {
+		return nil, err
+	}
+	return &tokenBucket{
+		rate:     rate,
+		capacity: capacity,
+		quantum:  quantum,
+		tokens:   float64(capacity),
+		updated:  now,
+		changed:  make(chan struct{}),
+	}, nil
+}
+
+// Checks that the bucket can be filled as described
+func validateBucket(rate float64, capacity, quantum int64) error {
+	switch {
+	case math.IsNaN(rate) || math.IsInf(rate, 0):
+		return fmt.Errorf("%w: rate %v is not a finite number of tokens per second", InvalidBucketConfig, rate)
+	case capacity < 1:
+		return fmt.Errorf("%w: capacity %d must be at least 1", InvalidBucketConfig, capacity)
+	case quantum > capacity:
+		return fmt.Errorf("%w: quantum %d exceeds capacity %d", InvalidBucketConfig, quantum, capacity)
+	}
+	return nil
+}
+
+func (me *tokenBucket) unlimited() bool {
+	return me.rate <= 0
+}
+
+// Changes the fill rate keeping the tokens that have accrued so far
+// Callers waiting on tokens that haven't accrued yet are woken so they can reschedule
+func (me *tokenBucket) setRate(now time.Time, rate float64) error {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+
+	if err := validateBucket(rate, me.capacity, me.quantum); err != nil {
+		return err
+	}
+	if me.unlimited() {
+		me.tokens = float64(me.capacity)
+	} else {
+		me.accrue(now)
+	}
+	// a partly accrued quantum is dropped rather than converted to the new rate
+	me.updated = now
+	me.rate = rate
+
+	// without debt every reservation is already usable so nobody needs waking
+	if me.tokens < 0 {
+		close(me.changed)
+		me.changed = make(chan struct{})
+	}
+	return nil
+}
+
+// Changes the number of tokens the bucket can hold
+// Shrinking discards tokens above the new capacity; growing does not add any
+func (me *tokenBucket) setCapacity(now time.Time, capacity int64) error {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+
+	if err := validateBucket(me.rate, capacity, me.quantum); err != nil {
+		return err
+	}
+	me.accrue(now)
+	me.capacity = capacity
+	me.tokens = math.Min(me.tokens, float64(capacity))
+	return nil
+}
+
+// Returns the current rate and a channel that is closed when it next changes
+func (me *tokenBucket) currentRate() (float64, <-chan struct{}) {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	return me.rate, me.changed
+}
+
+// Takes count tokens, going into debt if necessary
+// Returns the time at which the tokens will have accrued and the rate that time is based on
+// If that would be later than maxWait from now nothing is taken and false is returned
+func (me *tokenBucket) take(now time.Time, count int64, maxWait time.Duration) (time.Time, float64, bool) {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+
+	if count <= 0 || me.unlimited() {
+		return now, me.rate, true
+	}
+
+	me.accrue(now)
+	me.tokens -= float64(count)
+	wait := me.untilSettled(now)
+	if wait > maxWait {
+		me.tokens += float64(count)
+		return now, me.rate, false
+	}
+	return now.Add(wait), me.rate, true
+}
+
+// Takes up to count tokens without going into debt
+// Returns the number of tokens taken
+func (me *tokenBucket) takeAvailable(now time.Time, count int64) int64 {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+
+	if count <= 0 {
+		return 0
+	}
+	if me.unlimited() {
+		return count
+	}
+	me.accrue(now)
+	whole := int64(math.Floor(me.tokens))
+	if whole <= 0 {
+		return 0
+	}
+	count = min(count, whole)
+	me.tokens -= float64(count)
+	return count
+}
+
+// Returns count tokens that were taken but will never be used
+func (me *tokenBucket) refund(now time.Time, count int64) {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+
+	if me.unlimited() {
+		return
+	}
+	me.accrue(now)
+	me.tokens = math.Min(me.tokens+float64(count), float64(me.capacity))
+}
+
+func (me *tokenBucket) available(now time.Time) int64 {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+
+	if me.unlimited() {
+		return math.MaxInt64
+	}
+	me.accrue(now)
+	return int64(math.Floor(me.tokens))
+}
+
+func (me *tokenBucket) size() int64 {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	return me.capacity
+}
+
+// Moves a wait that was scheduled while the bucket filled at rate so that
+// the time remaining after now is spent at the current rate instead
+func (me *tokenBucket) reschedule(now, timeToAct time.Time, rate float64) (time.Time, float64) {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+
+	remaining := timeToAct.Sub(now)
+	switch {
+	case remaining <= 0 || rate <= 0:
+		return timeToAct, me.rate
+	case me.unlimited():
+		return now, me.rate
+	}
+	return now.Add(secondsToDuration(remaining.Seconds() * rate / me.rate)), me.rate
+}
+
+// Adds the tokens that have accrued since the last update
+// must be called with mu held while limited
+func (me *tokenBucket) accrue(now time.Time) {
+	elapsed := now.Sub(me.updated).Seconds()
+	if elapsed <= 0 {
+		return
+	}
+
+	if me.quantum < 1 {
+		me.tokens += elapsed * me.rate
+		me.updated = now
+	} else {
+		// only whole quanta are added; the time spent on the next one is carried over
+		perQuantum := float64(me.quantum) / me.rate
+		quanta := math.Floor(elapsed / perQuantum)
+		me.tokens += quanta * float64(me.quantum)
+		me.updated = me.updated.Add(secondsToDuration(quanta * perQuantum))
+	}
+
+	if me.tokens >= float64(me.capacity) {
+		// a full bucket stops filling so there is no progress to carry over
+		me.tokens = float64(me.capacity)
+		me.updated = now
+	}
+}
+
+// How long after now until the balance is no longer negative
+// must be called with mu held, straight after accrue
+func (me *tokenBucket) untilSettled(now time.Time) time.Duration {
+	if me.tokens >= 0 {
+		return 0
+	}
+
+	owed := -me.tokens
+	if me.quantum < 1 {
+		return secondsToDuration(owed / me.rate)
+	}
+	perQuantum := float64(me.quantum) / me.rate
+	quanta := math.Ceil(owed / float64(me.quantum))
+	return secondsToDuration(quanta*perQuantum) - now.Sub(me.updated)
+}
+
+// Converts seconds to a Duration, saturating instead of overflowing
+func secondsToDuration(seconds float64) time.Duration {
+	if seconds >= float64(infiniteDuration)/1e9 {
+		return infiniteDuration
+	}
+	return time.Duration(seconds * 1e9)
+}
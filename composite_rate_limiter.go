@@ -0,0 +1,172 @@
+package multilimiter
+
+import (
+	"context"
+	"math"
+	"sort"
+	"time"
+)
+
+// A RateLimiter that is only satisfied once every one of its limiters is
+// Use it to combine windows such as 10/s, 500/min and 10000/day
+type CompositeRateLimiter struct {
+	limiters []RateLimiter
+	canceler *Canceler
+}
+
+var _ RateLimiter = (*CompositeRateLimiter)(nil)
+var _ OutcomeListener = (*CompositeRateLimiter)(nil)
+
+func NewCompositeRateLimiter(limiters ...RateLimiter) *CompositeRateLimiter {
+	return &CompositeRateLimiter{limiters: limiters, canceler: NewCanceler()}
+}
+
+// The limiters that make up the composite
+func (me *CompositeRateLimiter) Limiters() []RateLimiter {
+	return append([]RateLimiter(nil), me.limiters...)
+}
+
+func (me *CompositeRateLimiter) Wait(ctx context.Context) error {
+	return me.WaitN(ctx, 1)
+}
+
+// Wait until tokens resources are available from every limiter
+// if tokens is < 1 nothing is taken and no waiting occurs
+func (me *CompositeRateLimiter) WaitN(ctx context.Context, tokens int64) error {
+	if me.canceler.IsCanceled() {
+		return LimiterStopped
+	}
+	if tokens < 1 {
+		return nil
+	}
+
+	return me.Reserve(tokens).Wait(ctx)
+}
+
+// Take a token only if every limiter has one available right now
+// Nothing is taken if any of them would make the caller wait
+func (me *CompositeRateLimiter) Allow() bool {
+	if me.canceler.IsCanceled() {
+		return false
+	}
+
+	reservation := me.Reserve(1)
+	if !reservation.OK() || reservation.Delay() > 0 {
+		reservation.Cancel()
+		return false
+	}
+	return true
+}
+
+// Reserves tokens from every limiter
+// Canceling the Reservation returns the tokens to all of them
+func (me *CompositeRateLimiter) Reserve(tokens int64) Reservation {
+	if me.canceler.IsCanceled() {
+		return stoppedReservation{}
+	}
+
+	reservations := make([]Reservation, len(me.limiters))
+	for i, lim := range me.limiters {
+		reservations[i] = lim.Reserve(tokens)
+	}
+	return &compositeReservation{reservations: reservations, done: me.canceler.Done()}
+}
+
+// The lowest rate of all the limiters, or 0 if none of them are limited
+func (me *CompositeRateLimiter) Rate() float64 {
+	rate := 0.0
+	for _, lim := range me.limiters {
+		if r := lim.Rate(); r > 0 && (rate == 0 || r < rate) {
+			rate = r
+		}
+	}
+	return rate
+}
+
+// Cancels the composite and every one of its limiters
+func (me *CompositeRateLimiter) Cancel() {
+	me.canceler.Cancel()
+	for _, lim := range me.limiters {
+		lim.Cancel()
+	}
+}
+
+// The fewest tokens available from any of the limiters
+func (me *CompositeRateLimiter) Available() int64 {
+	available := int64(math.MaxInt64)
+	for _, lim := range me.limiters {
+		if a := lim.Available(); a < available {
+			available = a
+		}
+	}
+	return available
+}
+
+// Passes the outcome on to each limiter that listens for outcomes
+func (me *CompositeRateLimiter) OnOutcome(outcome Outcome) {
+	for _, lim := range me.limiters {
+		if listener, ok := lim.(OutcomeListener); ok {
+			listener.OnOutcome(outcome)
+		}
+	}
+}
+
+// Reservations made against each of a CompositeRateLimiter's limiters
+type compositeReservation struct {
+	reservations []Reservation
+	done         <-chan struct{}
+}
+
+var _ Reservation = (*compositeReservation)(nil)
+
+func (me *compositeReservation) OK() bool {
+	for _, r := range me.reservations {
+		if !r.OK() {
+			return false
+		}
+	}
+	return true
+}
+
+// The longest delay of all the reservations
+func (me *compositeReservation) Delay() time.Duration {
+	var delay time.Duration
+	for _, r := range me.reservations {
+		if d := r.Delay(); d > delay {
+			delay = d
+		}
+	}
+	return delay
+}
+
+// Waits on every reservation
+// The longest is waited on first so that a deadline that cannot be met fails straight away
+// If any of them fails all of the tokens are returned
+func (me *compositeReservation) Wait(ctx context.Context) error {
+	started := time.Now()
+	select {
+	case <-me.done:
+		me.Cancel()
+		return newWaitError(StageRate, started, LimiterStopped)
+	default:
+	}
+
+	ordered := append([]Reservation(nil), me.reservations...)
+	sort.SliceStable(ordered, func(i, j int) bool {
+		return ordered[i].Delay() > ordered[j].Delay()
+	})
+
+	for _, r := range ordered {
+		if err := r.Wait(ctx); err != nil {
+			me.Cancel()
+			return err
+		}
+	}
+	return nil
+}
+
+func (me *compositeReservation) Cancel() {
+	for _, r := range me.reservations {
+		r.Cancel()
+	}
+}
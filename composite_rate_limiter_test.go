@@ -0,0 +1,74 @@
+package multilimiter_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/jrboelens/multilimiter"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestCompositeRateLimiterSpec(t *testing.T) {
+
+	Convey("CompositeRateLimiter tests ", t, func() {
+		perSecond := NewBucketRateLimiter(100.0, &multilimiter.BurstOption{Capacity: 10})
+		perMinute := NewBucketRateLimiter(1.0, &multilimiter.BurstOption{Capacity: 3})
+		lim := multilimiter.NewCompositeRateLimiter(perSecond, perMinute)
+		defer lim.Cancel()
+
+		Convey("is limited by its most restrictive limiter", func() {
+			for i := 0; i < 3; i++ {
+				So(lim.Wait(Context(time.Millisecond*20)), ShouldBeNil)
+			}
+
+			err := lim.Wait(Context(time.Millisecond * 20))
+			So(err, ShouldMatchError, multilimiter.DeadlineExceeded)
+			So(lim.Allow(), ShouldBeFalse)
+		})
+
+		Convey("refunds every limiter when one of them times out", func() {
+			So(lim.WaitN(Context(time.Millisecond*20), 3), ShouldBeNil)
+			before := perSecond.Available()
+
+			err := lim.Wait(Context(time.Millisecond * 20))
+			So(err, ShouldMatchError, multilimiter.DeadlineExceeded)
+			So(perSecond.Available(), ShouldEqual, before)
+			So(perMinute.Available(), ShouldEqual, 0)
+		})
+
+		Convey("Allow takes nothing unless every limiter has a token", func() {
+			perMinute.WaitN(Context(time.Second), 3)
+			before := perSecond.Available()
+
+			So(lim.Allow(), ShouldBeFalse)
+			So(perSecond.Available(), ShouldEqual, before)
+		})
+
+		Convey("reports the lowest rate and availability", func() {
+			So(lim.Rate(), ShouldEqual, 1.0)
+			So(lim.Available(), ShouldEqual, 3)
+		})
+
+		Convey("Cancel stops every limiter", func() {
+			lim.Cancel()
+			So(lim.Wait(Context(time.Second)), ShouldMatchError, multilimiter.LimiterStopped)
+			So(perSecond.Wait(Context(time.Second)), ShouldMatchError, multilimiter.LimiterStopped)
+		})
+
+		Convey("is used when several RateLimitOptions are given", func() {
+			limiter := multilimiter.NewLimiter(
+				&multilimiter.RateLimitOption{Limiter: perSecond},
+				&multilimiter.RateLimitOption{Limiter: perMinute},
+				&multilimiter.ConcLimitOption{Limiter: multilimiter.NewConcLimiter(10)},
+			)
+			defer limiter.Stop()
+
+			for i := 0; i < 3; i++ {
+				So(limiter.Do(Context(time.Second), func(context.Context) error { return nil }), ShouldBeNil)
+			}
+			err := limiter.Do(Context(time.Millisecond*20), func(context.Context) error { return nil })
+			So(err, ShouldMatchError, multilimiter.DeadlineExceeded)
+		})
+	})
+}
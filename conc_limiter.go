@@ -1,18 +1,23 @@
 package multilimiter
 
 import (
+	"container/list"
 	"context"
 	"sync"
+	"time"
 )
 
 // Provides a thread-safe mechanism for acquiring and releasing slots
 // Calling Stop() will unblock Acquire() if it's waiting on a slot
 type ConcLimiter interface {
 	// Wait for a slot to become available
-	// only DeadlineExceeded and LimiterStopped errors can be returned
+	// only errors matching DeadlineExceeded and LimiterStopped can be returned
 	Acquire(ctx context.Context) (Slot, error)
-	// Put the slot back into the pool
-	// Release()
+	// Wait for n slots to become available and acquire them as a single Slot
+	// WeightExceedsLimit is returned if n can never be satisfied
+	AcquireN(ctx context.Context, n int) (Slot, error)
+	// Acquire a slot only if one is available right now
+	TryAcquire() (Slot, bool)
 	// Cancels processing outstanding acquisition requests
 	Cancel()
 	// The configured concurrency
@@ -22,7 +27,11 @@ type ConcLimiter interface {
 }
 
 type Slot interface {
+	// Put the slot back into the pool
 	Release()
+	// Put the slot back into the pool reporting how long it was held and whether its work was dropped
+	// Adaptive limiters use this to adjust their limit; others treat it like Release()
+	ReleaseWithResult(rtt time.Duration, dropped bool)
 }
 
 type slot struct {
@@ -34,63 +43,286 @@ func (me *slot) Release() {
 	me.once.Do(me.releaseFn)
 }
 
+func (me *slot) ReleaseWithResult(rtt time.Duration, dropped bool) {
+	me.Release()
+}
+
+// A concurrency limiter that hands out weighted slots
+// By default waiters are served in the order they arrive so heavy requests cannot be starved by a stream of light ones
+// FairnessOption{FairnessNone} serves any waiter that fits instead, trading that guarantee for utilization
 type BasicConcLimiter struct {
-	size        int
-	slots, done chan struct{}
-	canceler    *Canceler
-	wg          sync.WaitGroup
+	slotPool
+	waiters arrivalQueue
 }
 
 var _ ConcLimiter = (*BasicConcLimiter)(nil)
 
 // Creates a new concurrency limiter
 // if size is <= 1, a default of 1 will be used
-func NewConcLimiter(size int) *BasicConcLimiter {
+func NewConcLimiter(size int, opts ...ConcOption) *BasicConcLimiter {
 	if size <= 1 {
 		size = 1
 	}
+	concOpts := createConcOptions(opts...)
+	fifo := concOpts.fairness == FairnessFIFO
 
-	slots := make(chan struct{}, size)
+	me := &BasicConcLimiter{
+		slotPool: slotPool{size: size, barging: !fifo, canceler: NewCanceler()},
+		waiters:  arrivalQueue{fifo: fifo},
+	}
+	me.queue = &me.waiters
+	return me
+}
+
+// Orders a BasicConcLimiter's waiters by arrival
+type arrivalQueue struct {
+	waiters list.List
+	fifo    bool
+}
 
-	for i := 0; i < size; i++ {
-		slots <- struct{}{}
+func (me *arrivalQueue) push(ctx context.Context, w *concWaiter) {
+	w.owner, w.elem = &me.waiters, me.waiters.PushBack(w)
+}
+
+func (me *arrivalQueue) remove(w *concWaiter) {
+	me.waiters.Remove(w.elem)
+}
+
+func (me *arrivalQueue) len() int {
+	return me.waiters.Len()
+}
+
+// Grants slots to waiters in arrival order
+// Under FIFO it stops at the first waiter that doesn't fit; otherwise it grants every waiter that does
+func (me *arrivalQueue) serve(pool *slotPool) {
+	for e := me.waiters.Front(); e != nil; {
+		next := e.Next()
+		if !pool.grant(e.Value.(*concWaiter)) {
+			if me.fifo {
+				// stop at the first waiter that doesn't fit so it isn't overtaken
+				return
+			}
+			e = next
+			continue
+		}
+		me.waiters.Remove(e)
+		e = next
 	}
+}
 
-	return &BasicConcLimiter{size: size, slots: slots, canceler: NewCanceler()}
+func (me *arrivalQueue) removeIf(drop func(*concWaiter) bool) {
+	for e := me.waiters.Front(); e != nil; {
+		next := e.Next()
+		if drop(e.Value.(*concWaiter)) {
+			me.waiters.Remove(e)
+		}
+		e = next
+	}
+}
+
+// Decides the order in which a slotPool's waiters are served
+// Every method is called with the pool's mu held
+type waitQueue interface {
+	// Queues w for the caller of ctx
+	push(ctx context.Context, w *concWaiter)
+	// Dequeues w once its caller has given up
+	remove(w *concWaiter)
+	// The number of queued waiters
+	len() int
+	// Offers waiters to pool.grant() in the order they should be served, dequeuing those it accepts
+	serve(pool *slotPool)
+	// Dequeues every waiter for which drop returns true
+	removeIf(drop func(*concWaiter) bool)
+}
+
+// A caller blocked in AcquireN
+type concWaiter struct {
+	n      int
+	ready  chan struct{}
+	queued time.Time
+	// set before ready is closed if the slots can no longer be granted
+	err error
+	// where the waiter is queued so that it can be dequeued if its caller gives up
+	owner *list.List
+	elem  *list.Element
+}
+
+// The slot accounting and waiter handoff shared by the concurrency limiters
+// Each limiter supplies the waitQueue that orders its waiters
+type slotPool struct {
+	size int
+	used int
+	// whether callers may take free slots while others are queued
+	barging  bool
+	mu       sync.Mutex
+	queue    waitQueue
+	canceler *Canceler
+	wg       sync.WaitGroup
 }
 
-func (me *BasicConcLimiter) Acquire(ctx context.Context) (Slot, error) {
+func (me *slotPool) Acquire(ctx context.Context) (Slot, error) {
+	return me.AcquireN(ctx, 1)
+}
+
+// Wait for n slots to become available and acquire them as a single Slot
+// if n is < 1, a weight of 1 will be used
+func (me *slotPool) AcquireN(ctx context.Context, n int) (Slot, error) {
 	if me.canceler.IsCanceled() {
 		return nil, LimiterStopped
 	}
+	if n < 1 {
+		n = 1
+	}
+
+	me.mu.Lock()
+	if n > me.size {
+		me.mu.Unlock()
+		return nil, WeightExceedsLimit
+	}
+
+	// unless barging only take the fast path when nobody is queued ahead of us
+	if (me.queue.len() == 0 || me.barging) && me.used+n <= me.size {
+		me.used += n
+		me.wg.Add(1)
+		me.mu.Unlock()
+		return me.newSlot(n), nil
+	}
+
+	started := time.Now()
+	w := &concWaiter{n: n, ready: make(chan struct{}), queued: started}
+	me.queue.push(ctx, w)
+	me.mu.Unlock()
 
 	// wait for a slot to become available
+	var err error
 	select {
+	case <-w.ready:
+		if w.err != nil {
+			return nil, w.err
+		}
+		return me.newSlot(n), nil
 	case <-me.canceler.Done():
-		return nil, LimiterStopped
+		err = newWaitError(StageConcurrency, started, LimiterStopped)
 	case <-ctx.Done():
-		return nil, DeadlineExceeded
-	case <-me.slots:
-		me.wg.Add(1)
-		return &slot{releaseFn: me.release}, nil
+		err = newWaitError(StageConcurrency, started, ctx.Err())
 	}
+
+	me.mu.Lock()
+	select {
+	case <-w.ready:
+		me.mu.Unlock()
+		if w.err == nil {
+			// the slots were granted while we were giving up; hand them back
+			me.release(n)
+		}
+		return nil, err
+	default:
+	}
+	me.queue.remove(w)
+	// the waiter may have been blocking the ones behind it
+	me.notifyWaiters()
+	me.mu.Unlock()
+	return nil, err
 }
 
-func (me *BasicConcLimiter) Cancel() {
+// Acquire a slot only if one is available right now
+// Returns false if the limiter is canceled or, unless barging, other callers are already waiting
+func (me *slotPool) TryAcquire() (Slot, bool) {
+	if me.canceler.IsCanceled() {
+		return nil, false
+	}
+
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	if (me.queue.len() > 0 && !me.barging) || me.used+1 > me.size {
+		return nil, false
+	}
+
+	me.used++
+	me.wg.Add(1)
+	return me.newSlot(1), true
+}
+
+func (me *slotPool) newSlot(n int) Slot {
+	return &slot{releaseFn: func() { me.release(n) }}
+}
+
+func (me *slotPool) Cancel() {
 	me.canceler.Cancel()
 }
 
-func (me *BasicConcLimiter) release() {
-	if me.size >= 1 {
-		me.wg.Done()
-		me.slots <- struct{}{}
+func (me *slotPool) release(n int) {
+	me.mu.Lock()
+	me.used -= n
+	me.notifyWaiters()
+	me.mu.Unlock()
+	me.wg.Done()
+}
+
+// must be called with mu held
+func (me *slotPool) notifyWaiters() {
+	me.queue.serve(me)
+}
+
+// Hands w its slots if they fit, returning false otherwise
+// must be called with mu held
+func (me *slotPool) grant(w *concWaiter) bool {
+	if me.used+w.n > me.size {
+		return false
 	}
+	me.used += w.n
+	me.wg.Add(1)
+	close(w.ready)
+	return true
 }
 
-func (me *BasicConcLimiter) Concurrency() int {
+// The target concurrency
+// After shrinking, InUse() may exceed this until enough slots are returned
+func (me *slotPool) Concurrency() int {
+	me.mu.Lock()
+	defer me.mu.Unlock()
 	return me.size
 }
 
-func (me *BasicConcLimiter) Wait() {
+// The number of slots currently held
+func (me *slotPool) InUse() int {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	return me.used
+}
+
+// Changes the concurrency while the limiter is in use
+// Growing hands the new slots to waiters immediately
+// Shrinking lets running work finish and absorbs returned slots until the new limit is reached
+// Waiters asking for more than the new concurrency fail with WeightExceedsLimit
+// if n is <= 1, a default of 1 will be used
+func (me *slotPool) SetConcurrency(n int) {
+	if n <= 1 {
+		n = 1
+	}
+
+	me.mu.Lock()
+	defer me.mu.Unlock()
+
+	me.size = n
+	me.queue.removeIf(func(w *concWaiter) bool {
+		if w.n <= n {
+			return false
+		}
+		w.err = WeightExceedsLimit
+		close(w.ready)
+		return true
+	})
+	me.notifyWaiters()
+}
+
+// The number of callers waiting for slots
+func (me *slotPool) Waiting() int {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	return me.queue.len()
+}
+
+func (me *slotPool) Wait() {
 	me.wg.Wait()
 }
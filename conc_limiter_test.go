@@ -1,6 +1,9 @@
 package multilimiter_test
 
 import (
+	"context"
+	"errors"
+	"sync"
 	"testing"
 	"time"
 
@@ -11,6 +14,7 @@ import (
 func TestConcLimiterSpec(t *testing.T) {
 
 	DEFAULT_CONCURRENCY := 10
+	timeout := 20 * time.Millisecond
 
 	Convey("ConcLimiter tests ", t, func() {
 
@@ -31,7 +35,7 @@ func TestConcLimiterSpec(t *testing.T) {
 			lim.Cancel()
 
 			_, err = lim.Acquire(Context(timeout))
-			So(err, ShouldEqual, multilimiter.LimiterStopped)
+			So(err, ShouldMatchError, multilimiter.LimiterStopped)
 		})
 
 		Convey("Acquire adheres to a timeout", func() {
@@ -60,7 +64,45 @@ func TestConcLimiterSpec(t *testing.T) {
 			<-done
 
 			So(err1, ShouldBeNil)
-			So(err2, ShouldEqual, multilimiter.DeadlineExceeded)
+			So(err2, ShouldMatchError, multilimiter.DeadlineExceeded)
+		})
+
+		Convey("Acquire reports why it gave up", func() {
+			lim := multilimiter.NewConcLimiter(1)
+			slot, _ := lim.Acquire(Context(timeout))
+			defer slot.Release()
+
+			Convey("when the deadline passes", func() {
+				_, err := lim.Acquire(Context(timeout))
+
+				var waitErr *multilimiter.WaitError
+				So(errors.As(err, &waitErr), ShouldBeTrue)
+				So(waitErr.Stage, ShouldEqual, multilimiter.StageConcurrency)
+				So(waitErr.Waited, ShouldBeGreaterThanOrEqualTo, timeout)
+				So(err, ShouldMatchError, context.DeadlineExceeded)
+				So(err, ShouldMatchError, multilimiter.DeadlineExceeded)
+			})
+
+			Convey("when the context is canceled", func() {
+				ctx, cancel := ContextWithCancel(0)
+				cancel()
+				_, err := lim.Acquire(ctx)
+
+				So(err, ShouldMatchError, context.Canceled)
+				So(err, ShouldMatchError, multilimiter.DeadlineExceeded)
+				So(errors.Is(err, context.DeadlineExceeded), ShouldBeFalse)
+			})
+
+			Convey("when the limiter is canceled", func() {
+				go func() {
+					time.Sleep(timeout / 2)
+					lim.Cancel()
+				}()
+				_, err := lim.Acquire(Context(timeout * 4))
+
+				So(err, ShouldMatchError, multilimiter.LimiterStopped)
+				So(errors.Is(err, multilimiter.DeadlineExceeded), ShouldBeFalse)
+			})
 		})
 
 		Convey("Acquire allows a 0 timeout", func() {
@@ -70,6 +112,250 @@ func TestConcLimiterSpec(t *testing.T) {
 			So(err, ShouldBeNil)
 		})
 
+		Convey("AcquireN", func() {
+			Convey("consumes n slots", func() {
+				lim := multilimiter.NewConcLimiter(4)
+
+				heavy, err := lim.AcquireN(Context(timeout), 3)
+				So(err, ShouldBeNil)
+
+				light, err := lim.Acquire(Context(timeout))
+				So(err, ShouldBeNil)
+
+				_, err = lim.Acquire(Context(timeout))
+				So(err, ShouldMatchError, multilimiter.DeadlineExceeded)
+
+				heavy.Release()
+				light.Release()
+				So(WaitsWithin(lim.Wait, time.Second), ShouldBeTrue)
+			})
+
+			Convey("rejects weights larger than the concurrency", func() {
+				lim := multilimiter.NewConcLimiter(2)
+				_, err := lim.AcquireN(Context(timeout), 3)
+				So(err, ShouldEqual, multilimiter.WeightExceedsLimit)
+			})
+
+			Convey("does not starve heavy requests behind light ones", func() {
+				lim := multilimiter.NewConcLimiter(4)
+
+				first, err := lim.Acquire(Context(timeout))
+				So(err, ShouldBeNil)
+
+				heavyAcquired := make(chan multilimiter.Slot)
+				go func() {
+					heavy, _ := lim.AcquireN(Context(time.Second), 4)
+					heavyAcquired <- heavy
+				}()
+				time.Sleep(timeout)
+
+				// capacity is free but the heavy request is queued first
+				_, err = lim.Acquire(Context(timeout))
+				So(err, ShouldMatchError, multilimiter.DeadlineExceeded)
+
+				first.Release()
+				heavy := <-heavyAcquired
+				So(heavy, ShouldNotBeNil)
+				heavy.Release()
+
+				So(WaitsWithin(lim.Wait, time.Second), ShouldBeTrue)
+			})
+
+			Convey("lets waiters behind a timed out heavy request proceed", func() {
+				lim := multilimiter.NewConcLimiter(2)
+
+				first, err := lim.Acquire(Context(timeout))
+				So(err, ShouldBeNil)
+
+				go lim.AcquireN(Context(timeout), 2)
+				time.Sleep(timeout / 4)
+
+				_, err = lim.Acquire(Context(timeout * 4))
+				So(err, ShouldBeNil)
+				first.Release()
+			})
+		})
+
+		Convey("TryAcquire", func() {
+			Convey("returns a slot when one is available", func() {
+				lim := multilimiter.NewConcLimiter(1)
+				slot, ok := lim.TryAcquire()
+				So(ok, ShouldBeTrue)
+
+				_, ok = lim.TryAcquire()
+				So(ok, ShouldBeFalse)
+
+				slot.Release()
+				slot, ok = lim.TryAcquire()
+				So(ok, ShouldBeTrue)
+				slot.Release()
+			})
+
+			Convey("does not jump ahead of waiters", func() {
+				lim := multilimiter.NewConcLimiter(2)
+				first, _ := lim.Acquire(Context(timeout))
+
+				go lim.AcquireN(Context(timeout*4), 2)
+				time.Sleep(timeout / 2)
+
+				_, ok := lim.TryAcquire()
+				So(ok, ShouldBeFalse)
+				first.Release()
+			})
+
+			Convey("fails once canceled", func() {
+				lim := multilimiter.NewConcLimiter(DEFAULT_CONCURRENCY)
+				lim.Cancel()
+				_, ok := lim.TryAcquire()
+				So(ok, ShouldBeFalse)
+			})
+		})
+
+		Convey("SetConcurrency", func() {
+			Convey("growing releases waiters immediately", func() {
+				lim := multilimiter.NewConcLimiter(1)
+				first, _ := lim.Acquire(Context(timeout))
+				defer first.Release()
+
+				acquired := make(chan error)
+				go func() {
+					_, err := lim.Acquire(Context(time.Second))
+					acquired <- err
+				}()
+				time.Sleep(timeout / 2)
+
+				lim.SetConcurrency(2)
+				So(lim.Concurrency(), ShouldEqual, 2)
+				So(<-acquired, ShouldBeNil)
+				So(lim.InUse(), ShouldEqual, 2)
+			})
+
+			Convey("shrinking absorbs returned slots until the new limit is reached", func() {
+				lim := multilimiter.NewConcLimiter(3)
+				var slots []multilimiter.Slot
+				for i := 0; i < 3; i++ {
+					slot, _ := lim.Acquire(Context(timeout))
+					slots = append(slots, slot)
+				}
+
+				lim.SetConcurrency(1)
+				So(lim.Concurrency(), ShouldEqual, 1)
+				So(lim.InUse(), ShouldEqual, 3)
+
+				slots[0].Release()
+				_, ok := lim.TryAcquire()
+				So(ok, ShouldBeFalse)
+
+				slots[1].Release()
+				_, ok = lim.TryAcquire()
+				So(ok, ShouldBeFalse)
+
+				slots[2].Release()
+				slot, ok := lim.TryAcquire()
+				So(ok, ShouldBeTrue)
+				So(lim.InUse(), ShouldEqual, 1)
+				slot.Release()
+			})
+
+			Convey("shrinking fails waiters that can no longer fit", func() {
+				lim := multilimiter.NewConcLimiter(3)
+				first, _ := lim.Acquire(Context(timeout))
+				defer first.Release()
+
+				acquired := make(chan error)
+				go func() {
+					_, err := lim.AcquireN(Context(time.Second), 3)
+					acquired <- err
+				}()
+				time.Sleep(timeout / 2)
+
+				lim.SetConcurrency(2)
+				So(<-acquired, ShouldEqual, multilimiter.WeightExceedsLimit)
+			})
+		})
+
+		Convey("Fairness", func() {
+			// all 4 slots are held, 1 of them separately, while a heavy caller queues ahead of two light ones
+			queueBehindHeavy := func(lim *multilimiter.BasicConcLimiter) (*AdmissionRecorder, multilimiter.Slot) {
+				held, _ := lim.AcquireN(context.Background(), 3)
+				single, _ := lim.Acquire(context.Background())
+				recorder := &AdmissionRecorder{lim: lim, held: held}
+				recorder.QueueN("H", context.Background(), 4)
+				recorder.Queue("L", context.Background())
+				recorder.Queue("L", context.Background())
+				return recorder, single
+			}
+
+			Convey("FIFO does not let light callers overtake a heavy one", func() {
+				recorder, single := queueBehindHeavy(multilimiter.NewConcLimiter(4))
+
+				// the freed slot fits a light caller but the heavy one is first in line
+				single.Release()
+				So(recorder.lim.Waiting(), ShouldEqual, 3)
+
+				So(recorder.Release(), ShouldEqual, "HLL")
+			})
+
+			Convey("FIFO keeps the p99 wait of heavy callers bounded under contention", func() {
+				lim := multilimiter.NewConcLimiter(4)
+
+				// light callers keep all 4 slots busy while heavy callers ask for all of them
+				stop := make(chan struct{})
+				var wg sync.WaitGroup
+				for i := 0; i < 8; i++ {
+					wg.Add(1)
+					go func() {
+						defer wg.Done()
+						for {
+							select {
+							case <-stop:
+								return
+							default:
+							}
+							if slot, err := lim.Acquire(Context(time.Second)); err == nil {
+								time.Sleep(time.Millisecond * 2)
+								slot.Release()
+							}
+						}
+					}()
+				}
+				defer wg.Wait()
+				defer close(stop)
+
+				// the bound is loose so that a slow machine doesn't fail the test; starvation would blow well past it
+				var waits []time.Duration
+				for i := 0; i < 20; i++ {
+					started := time.Now()
+					slot, err := lim.AcquireN(Context(time.Second), 4)
+					So(err, ShouldBeNil)
+					waits = append(waits, time.Since(started))
+					slot.Release()
+				}
+				So(Percentile(waits, 99), ShouldBeLessThan, time.Millisecond*250)
+			})
+
+			Convey("FairnessNone lets light callers overtake a heavy one", func() {
+				lim := multilimiter.NewConcLimiter(4, &multilimiter.FairnessOption{Fairness: multilimiter.FairnessNone})
+				recorder, single := queueBehindHeavy(lim)
+
+				single.Release()
+				WaitForWaiters(lim, 1)
+
+				So(recorder.Release(), ShouldEqual, "LLH")
+			})
+
+			Convey("FairnessNone serves a waiter that fits ahead of one that doesn't", func() {
+				lim := multilimiter.NewConcLimiter(2, &multilimiter.FairnessOption{Fairness: multilimiter.FairnessNone})
+				held, _ := lim.Acquire(Context(time.Second))
+				go lim.AcquireN(Context(time.Millisecond*100), 2)
+				WaitForWaiters(lim, 1)
+
+				_, ok := lim.TryAcquire()
+				So(ok, ShouldBeTrue)
+				held.Release()
+			})
+		})
+
 		Convey("Concurrency returns the original input parameter", func() {
 			lim := multilimiter.NewConcLimiter(DEFAULT_CONCURRENCY)
 			So(lim.Concurrency(), ShouldEqual, DEFAULT_CONCURRENCY)
@@ -1,6 +1,79 @@
 package multilimiter
 
-import "errors"
+import (
+	"errors"
+	"fmt"
+	"time"
+)
 
 var LimiterStopped = errors.New("Limiter has been stopped")
 var DeadlineExceeded = errors.New("Timeout Exceeded")
+var WeightExceedsLimit = errors.New("Requested weight exceeds the limiter's capacity")
+var KeyLimitReached = errors.New("Key limit reached and no idle keys can be evicted")
+
+// Returned to callers shed by the MaxQueueLengthOption, whether the queue was full or backed up
+var ErrQueueFull = errors.New("Too many callers are waiting on the limiter")
+
+var InvalidBucketConfig = errors.New("Invalid token bucket configuration")
+
+// Identifies which part of a limiter a caller was waiting on
+type Stage string
+
+const (
+	StageConcurrency Stage = "concurrency"
+	StageRate        Stage = "rate"
+)
+
+// Returned when a caller gives up waiting on a limiter
+// Err is ctx.Err() when the caller's context finished, otherwise LimiterStopped
+// errors.Is matches DeadlineExceeded for context errors so existing checks keep working,
+// while errors.Is(err, context.Canceled) tells an explicit cancellation apart from a timeout
+type WaitError struct {
+	// The stage that was being waited on
+	Stage Stage
+	// How long the caller waited before giving up
+	Waited time.Duration
+	Err    error
+}
+
+func newWaitError(stage Stage, started time.Time, err error) *WaitError {
+	return &WaitError{Stage: stage, Waited: time.Since(started), Err: err}
+}
+
+func (me *WaitError) Error() string {
+	return fmt.Sprintf("gave up waiting on %s after %s: %v", me.Stage, me.Waited, me.Err)
+}
+
+func (me *WaitError) Unwrap() error {
+	return me.Err
+}
+
+func (me *WaitError) Is(target error) bool {
+	return target == DeadlineExceeded && me.Err != LimiterStopped
+}
+
+// Wraps the value recovered from a panicking function
+type PanicError struct {
+	// The value passed to panic()
+	Value interface{}
+	// The stack trace of the panicking go routine
+	Stack []byte
+}
+
+func (me *PanicError) Error() string {
+	return fmt.Sprintf("Panic found in BasicLimiter: %v", me.Value)
+}
+
+// Returned by BasicLimiter.Shutdown() when functions were still running once its context finished
+type ShutdownError struct {
+	ShutdownSummary
+	Err error
+}
+
+func (me *ShutdownError) Error() string {
+	return fmt.Sprintf("shutdown abandoned %d running functions after draining %d: %v", me.Abandoned, me.Drained, me.Err)
+}
+
+func (me *ShutdownError) Unwrap() error {
+	return me.Err
+}
@@ -9,16 +9,14 @@ import (
 	"github.com/jrboelens/multilimiter"
 )
 
-func DoWork(lim multilimiter.Limiter, iterations, sleepMs int) {
-	tracker := &multilimiter.ConcurrencyTracker{}
+// The tracker is registered as an observer of lim so the work doesn't need to update it
+func DoWork(lim multilimiter.Limiter, tracker *multilimiter.ConcurrencyTracker, iterations, sleepMs int) {
 	tracker.Start()
 	for i := 0; i < iterations; i++ {
 		lim.Execute(context.Background(), func(ctx context.Context) {
-			tracker.Add()
 			if sleepMs > 0 {
 				time.Sleep(time.Duration(sleepMs) * time.Millisecond)
 			}
-			tracker.Subtract()
 		})
 	}
 	lim.Wait()
@@ -43,14 +41,16 @@ func main() {
 	flag.IntVar(&sleepMs, "sleepMs", 1, "number of milliseconds to sleep during each Execute()")
 	flag.Parse()
 
-	rateOpt := &multilimiter.RateLimitOption{multilimiter.NewRateLimiter(rate)}
-	concOpt := &multilimiter.ConcLimitOption{multilimiter.NewConcLimiter(concurrency)}
-	lim := multilimiter.NewLimiter(rateOpt, concOpt)
+	rateOpt := &multilimiter.RateLimitOption{Limiter: multilimiter.NewRateLimiter(rate)}
+	concOpt := &multilimiter.ConcLimitOption{Limiter: multilimiter.NewConcLimiter(concurrency)}
+	tracker := &multilimiter.ConcurrencyTracker{}
+	observerOpt := &multilimiter.ObserverOption{Observer: tracker}
+	lim := multilimiter.NewLimiter(rateOpt, concOpt, observerOpt)
 
 	// Default Limiter offers a more easy way to create a Limiter
 	//lim := multilimiter.DefaultLimiter(rate, concurrency)
 
 	fmt.Printf("Starting Limiter for %d iterations at %f/s with %d concurrency\n", iterations, rate, concurrency)
-	DoWork(lim, iterations, sleepMs)
+	DoWork(lim, tracker, iterations, sleepMs)
 	fmt.Printf("\n")
 }
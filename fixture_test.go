@@ -2,6 +2,11 @@ package multilimiter_test
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/jrboelens/multilimiter"
@@ -23,10 +28,58 @@ func NewLimiter(rate float64, concurrency int) multilimiter.Limiter {
 	return multilimiter.DefaultLimiter(rate, concurrency)
 }
 
+func NewBasicLimiter(rate float64, concurrency int) *multilimiter.BasicLimiter {
+	return multilimiter.DefaultLimiter(rate, concurrency)
+}
+
+// Creates a BasicRateLimiter from options that are known to be valid
+func NewBucketRateLimiter(rate float64, opts ...multilimiter.BucketOption) *multilimiter.BasicRateLimiter {
+	lim, err := multilimiter.NewBasicRateLimiter(rate, opts...)
+	if err != nil {
+		panic(err)
+	}
+	return lim
+}
+
+// Creates an AdaptiveRateLimiter from options that are known to be valid
+func NewAdaptiveRateLimiter(initial, floor, ceiling float64, policy *multilimiter.AdaptiveRatePolicy, opts ...multilimiter.BucketOption) *multilimiter.AdaptiveRateLimiter {
+	lim, err := multilimiter.NewAdaptiveRateLimiter(initial, floor, ceiling, policy, opts...)
+	if err != nil {
+		panic(err)
+	}
+	return lim
+}
+
 func NewDefaultLimiter() multilimiter.Limiter {
 	return NewLimiter(DEFAULT_RATE, DEFAULT_CONCURRENCY)
 }
 
+// Asserts that errors.Is(actual, expected) is true
+func ShouldMatchError(actual interface{}, expected ...interface{}) string {
+	err, _ := actual.(error)
+	target, _ := expected[0].(error)
+	if errors.Is(err, target) {
+		return ""
+	}
+	return fmt.Sprintf("Expected: '%v' to match '%v'", actual, target)
+}
+
+// Returns true if fn returns before the timeout elapses
+func WaitsWithin(fn func(), timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		fn()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
 type SlowRateLimiter struct {
 	multilimiter.TestableRateLimiter
 	tokens int64
@@ -36,7 +89,89 @@ func (me *SlowRateLimiter) Wait(ctx context.Context) error {
 	return me.TestableRateLimiter.XXX_TEST_Wait(me.tokens, ctx)
 }
 
+func (me *SlowRateLimiter) WaitN(ctx context.Context, tokens int64) error {
+	return me.TestableRateLimiter.XXX_TEST_Wait(me.tokens*tokens, ctx)
+}
+
+func (me *SlowRateLimiter) Reserve(tokens int64) multilimiter.Reservation {
+	return me.TestableRateLimiter.Reserve(me.tokens * tokens)
+}
+
 // This is just here to satisfy the interface
 func (me *SlowRateLimiter) XXX_TEST_Wait(tokens int64, ctx context.Context) error {
 	return me.TestableRateLimiter.XXX_TEST_Wait(tokens, ctx)
 }
+
+// Returns the duration below which p percent of durations fall
+func Percentile(durations []time.Duration, p float64) time.Duration {
+	if len(durations) == 0 {
+		return 0
+	}
+	sorted := append([]time.Duration(nil), durations...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	i := int(float64(len(sorted)-1) * p / 100)
+	return sorted[i]
+}
+
+// A concurrency limiter that reports how many callers are queued
+type QueueingConcLimiter interface {
+	multilimiter.ConcLimiter
+	Waiting() int
+}
+
+// Records the order in which queued callers acquire slots from a limiter
+type AdmissionRecorder struct {
+	lim    QueueingConcLimiter
+	held   multilimiter.Slot
+	queued int
+	mu     sync.Mutex
+	order  strings.Builder
+	wg     sync.WaitGroup
+}
+
+// Holds the only slot of lim and queues a caller for each name using ctxs[name]
+func HoldAndQueue(lim QueueingConcLimiter, ctxs map[string]context.Context, names ...string) *AdmissionRecorder {
+	held, _ := lim.Acquire(context.Background())
+	recorder := &AdmissionRecorder{lim: lim, held: held}
+	for _, name := range names {
+		recorder.Queue(name, ctxs[name])
+	}
+	return recorder
+}
+
+// Queues a caller and waits until it is waiting
+func (me *AdmissionRecorder) Queue(name string, ctx context.Context) {
+	me.QueueN(name, ctx, 1)
+}
+
+// Queues a caller asking for n slots and waits until it is waiting
+func (me *AdmissionRecorder) QueueN(name string, ctx context.Context, n int) {
+	me.wg.Add(1)
+	go func() {
+		defer me.wg.Done()
+		slot, err := me.lim.AcquireN(ctx, n)
+		if err != nil {
+			return
+		}
+		me.mu.Lock()
+		me.order.WriteString(name)
+		me.mu.Unlock()
+		slot.Release()
+	}()
+	me.queued++
+	WaitForWaiters(me.lim, me.queued)
+}
+
+// Releases the held slot and returns the order the queued callers ran in
+func (me *AdmissionRecorder) Release() string {
+	me.held.Release()
+	me.wg.Wait()
+	return me.order.String()
+}
+
+// Waits until exactly n callers are queued on lim
+func WaitForWaiters(lim QueueingConcLimiter, n int) {
+	for lim.Waiting() != n {
+		time.Sleep(time.Millisecond)
+	}
+}
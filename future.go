@@ -0,0 +1,58 @@
+package multilimiter
+
+import "context"
+
+// A handle to the result of a function submitted to a Limiter
+// The zero value is not usable; Futures are created by BasicLimiter.Submit()
+type Future struct {
+	done   chan struct{}
+	result interface{}
+	err    error
+}
+
+func newFuture() *Future {
+	return &Future{done: make(chan struct{})}
+}
+
+// Creates a Future that has already completed with err
+func failedFuture(err error) *Future {
+	f := newFuture()
+	f.complete(nil, err)
+	return f
+}
+
+func (me *Future) complete(result interface{}, err error) {
+	me.result = result
+	me.err = err
+	close(me.done)
+}
+
+// Closed once the submitted function has completed
+func (me *Future) Done() <-chan struct{} {
+	return me.done
+}
+
+// Waits for the submitted function to complete and returns its error
+// If ctx is done first, ctx.Err() is returned and the function keeps running
+func (me *Future) Wait(ctx context.Context) error {
+	select {
+	case <-me.done:
+		return me.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Blocks until the submitted function completes and returns its result
+func (me *Future) Result() interface{} {
+	<-me.done
+	return me.result
+}
+
+// Blocks until the submitted function completes and returns its error
+// The error is the one returned by the limiter if acquisition failed,
+// a *PanicError if the function panicked, otherwise the function's own error
+func (me *Future) Err() error {
+	<-me.done
+	return me.err
+}
@@ -0,0 +1,115 @@
+package multilimiter_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/jrboelens/multilimiter"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestFutureSpec(t *testing.T) {
+
+	DEFAULT_CONTEXT := func() context.Context {
+		return Context(time.Millisecond * 2000)
+	}
+
+	Convey("Future tests ", t, func() {
+
+		Convey("Result returns the submitted function's result", func() {
+			lim := NewBasicLimiter(DEFAULT_RATE, DEFAULT_CONCURRENCY)
+			defer lim.Stop()
+
+			future := lim.Submit(DEFAULT_CONTEXT(), func(context.Context) (interface{}, error) {
+				return "done", nil
+			})
+
+			So(future.Wait(DEFAULT_CONTEXT()), ShouldBeNil)
+			So(future.Result(), ShouldEqual, "done")
+			So(future.Err(), ShouldBeNil)
+		})
+
+		Convey("Err returns the submitted function's error", func() {
+			lim := NewBasicLimiter(DEFAULT_RATE, DEFAULT_CONCURRENCY)
+			defer lim.Stop()
+
+			expected := errors.New("failed")
+			future := lim.Submit(DEFAULT_CONTEXT(), func(context.Context) (interface{}, error) {
+				return nil, expected
+			})
+
+			So(future.Err(), ShouldEqual, expected)
+		})
+
+		Convey("Err returns the recovered panic value", func() {
+			lim := NewBasicLimiter(DEFAULT_RATE, DEFAULT_CONCURRENCY)
+			defer lim.Stop()
+
+			future := lim.Submit(DEFAULT_CONTEXT(), func(context.Context) (interface{}, error) {
+				panic("boom")
+			})
+
+			var panicErr *multilimiter.PanicError
+			So(errors.As(future.Err(), &panicErr), ShouldBeTrue)
+			So(panicErr.Value, ShouldEqual, "boom")
+			So(len(panicErr.Stack), ShouldBeGreaterThan, 0)
+
+			// the slot must have been returned
+			So(WaitsWithin(func() { lim.Wait() }, time.Second), ShouldBeTrue)
+		})
+
+		Convey("Err returns acquisition errors", func() {
+			lim := NewBasicLimiter(DEFAULT_RATE, DEFAULT_CONCURRENCY)
+			lim.Stop()
+
+			future := lim.Submit(DEFAULT_CONTEXT(), func(context.Context) (interface{}, error) {
+				return nil, nil
+			})
+
+			So(future.Err(), ShouldEqual, multilimiter.LimiterStopped)
+		})
+
+		Convey("Done is closed once the function completes", func() {
+			lim := NewBasicLimiter(DEFAULT_RATE, 2)
+			defer lim.Stop()
+
+			release := make(chan struct{})
+			slow := lim.Submit(DEFAULT_CONTEXT(), func(context.Context) (interface{}, error) {
+				<-release
+				return 1, nil
+			})
+			fast := lim.Submit(DEFAULT_CONTEXT(), func(context.Context) (interface{}, error) {
+				return 2, nil
+			})
+
+			<-fast.Done()
+			select {
+			case <-slow.Done():
+				So(false, ShouldBeTrue)
+			default:
+			}
+
+			close(release)
+			<-slow.Done()
+			So(slow.Result(), ShouldEqual, 1)
+			So(fast.Result(), ShouldEqual, 2)
+		})
+
+		Convey("Wait adheres to its context", func() {
+			lim := NewBasicLimiter(DEFAULT_RATE, DEFAULT_CONCURRENCY)
+			defer lim.Stop()
+
+			release := make(chan struct{})
+			defer close(release)
+			future := lim.Submit(DEFAULT_CONTEXT(), func(context.Context) (interface{}, error) {
+				<-release
+				return nil, nil
+			})
+
+			err := future.Wait(Context(time.Millisecond * 20))
+			So(errors.Is(err, context.DeadlineExceeded), ShouldBeTrue)
+		})
+	})
+}
@@ -0,0 +1,292 @@
+package multilimiter
+
+import (
+	"context"
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// A lock free RateLimiter based on the generic cell rate algorithm
+// The only state is the theoretical arrival time (tat) of the next token which is updated with compare and swap
+// There are no background go routines and Allow() and Wait()s that don't need to sleep allocate nothing
+// BurstOption and InitialTokensOption are honored; QuantumOption is ignored
+type GCRARateLimiter struct {
+	// nanoseconds between tokens; 0 means no limit
+	interval int64
+	// how far tat may run ahead of now before callers must wait
+	tolerance int64
+	// tat is measured in nanoseconds since epoch so that the monotonic clock is used
+	epoch    time.Time
+	tat      atomic.Int64
+	canceler *Canceler
+}
+
+var _ RateLimiter = (*GCRARateLimiter)(nil)
+
+// Timers reused by Wait() so that sleeping does not allocate
+var gcraTimers = sync.Pool{
+	New: func() interface{} {
+		timer := time.NewTimer(infiniteDuration)
+		timer.Stop()
+		return timer
+	},
+}
+
+// Creates a GCRA rate limiter allowing rate tokens per second
+// A rate <= 0 means no limit
+// The capacity is capped so that a full burst's worth of time fits in an int64
+func NewGCRARateLimiter(rate float64, opts ...BucketOption) *GCRARateLimiter {
+	bucketOpts := createBucketOptions(opts...)
+
+	me := &GCRARateLimiter{epoch: time.Now(), canceler: NewCanceler()}
+	if rate <= 0 {
+		return me
+	}
+
+	me.interval = int64(math.Max(1, float64(time.Second)/rate))
+	capacity := min(max(bucketOpts.capacity, 1), math.MaxInt64/me.interval)
+	me.tolerance = capacity * me.interval
+
+	// the limiter starts full so push tat forward by whatever shouldn't be there
+	if bucketOpts.initial != nil {
+		initial := min(max(*bucketOpts.initial, 0), capacity)
+		me.tat.Store((capacity - initial) * me.interval)
+	}
+	return me
+}
+
+func (me *GCRARateLimiter) Wait(ctx context.Context) error {
+	return me.WaitN(ctx, 1)
+}
+
+// Wait until tokens resources are available
+// if tokens is < 1 nothing is taken and no waiting occurs
+// WeightExceedsLimit is returned if tokens is more than the Capacity()
+func (me *GCRARateLimiter) WaitN(ctx context.Context, tokens int64) error {
+	if me.canceler.IsCanceled() {
+		return LimiterStopped
+	}
+	if tokens < 1 || me.interval == 0 {
+		return nil
+	}
+	if tokens > me.Capacity() {
+		return WeightExceedsLimit
+	}
+
+	delay, _ := me.take(tokens, false)
+	if delay == 0 {
+		return nil
+	}
+
+	if err := me.sleep(ctx, delay); err != nil {
+		me.refund(tokens)
+		return err
+	}
+	return nil
+}
+
+// Take a token only if one is available right now
+// Returns false if the limiter is canceled
+func (me *GCRARateLimiter) Allow() bool {
+	return me.AllowN(1)
+}
+
+// Take tokens only if all of them are available right now
+// Returns false if the limiter is canceled or tokens is more than the Capacity()
+func (me *GCRARateLimiter) AllowN(tokens int64) bool {
+	if me.canceler.IsCanceled() {
+		return false
+	}
+	if tokens < 1 || me.interval == 0 {
+		return true
+	}
+	if tokens > me.Capacity() {
+		return false
+	}
+
+	_, ok := me.take(tokens, true)
+	return ok
+}
+
+// Take tokens now and report how long to wait before using them
+// Canceling the Reservation returns the tokens
+// Reservations for more than the Capacity() are not OK and waiting on them fails with WeightExceedsLimit
+// Unlike WaitN() this allocates; callers that have nothing to roll back should prefer WaitN()
+func (me *GCRARateLimiter) Reserve(tokens int64) Reservation {
+	if me.canceler.IsCanceled() {
+		return stoppedReservation{}
+	}
+	if tokens < 1 || me.interval == 0 {
+		return immediateReservation{}
+	}
+	if tokens > me.Capacity() {
+		return oversizedReservation{}
+	}
+
+	delay, _ := me.take(tokens, false)
+	return &gcraReservation{limiter: me, tokens: tokens, timeToAct: time.Now().Add(delay)}
+}
+
+func (me *GCRARateLimiter) Rate() float64 {
+	if me.interval == 0 {
+		return 0
+	}
+	return float64(time.Second) / float64(me.interval)
+}
+
+// The maximum number of tokens that can be taken at once
+func (me *GCRARateLimiter) Capacity() int64 {
+	if me.interval == 0 {
+		return math.MaxInt64
+	}
+	return me.tolerance / me.interval
+}
+
+// The number of tokens that can currently be taken without waiting
+// This is negative when callers are already waiting on future tokens
+func (me *GCRARateLimiter) Available() int64 {
+	if me.interval == 0 {
+		return math.MaxInt64
+	}
+
+	now := me.now()
+	tat := max(me.tat.Load(), now)
+	return floorDiv(now+me.tolerance-tat, me.interval)
+}
+
+// Like Available() but never less than 0
+func (me *GCRARateLimiter) Remaining() int64 {
+	return max(me.Available(), 0)
+}
+
+// How long until tokens could be taken without waiting
+// Nothing is taken; 0 is returned if they are available now
+// and an effectively infinite duration if tokens is more than the Capacity()
+func (me *GCRARateLimiter) RetryAfter(tokens int64) time.Duration {
+	if me.interval == 0 || tokens < 1 {
+		return 0
+	}
+	if tokens > me.Capacity() {
+		return infiniteDuration
+	}
+
+	now := me.now()
+	tat := max(me.tat.Load(), now)
+	return time.Duration(max(tat+tokens*me.interval-me.tolerance-now, 0))
+}
+
+func (me *GCRARateLimiter) Cancel() {
+	me.canceler.Cancel()
+}
+
+// Moves tat forward by tokens and reports how long to wait before they can be used
+// if onlyIfReady tat is left alone unless the tokens can be used now
+// tokens must be between 1 and the Capacity() so that their cost cannot overflow
+func (me *GCRARateLimiter) take(tokens int64, onlyIfReady bool) (time.Duration, bool) {
+	now := me.now()
+	cost := tokens * me.interval
+	for {
+		tat := me.tat.Load()
+		newTat := max(tat, now) + cost
+		delay := newTat - me.tolerance - now
+		if delay > 0 && onlyIfReady {
+			return time.Duration(delay), false
+		}
+		if me.tat.CompareAndSwap(tat, newTat) {
+			return time.Duration(max(delay, 0)), true
+		}
+	}
+}
+
+// Gives back tokens that won't be used
+func (me *GCRARateLimiter) refund(tokens int64) {
+	me.tat.Add(-tokens * me.interval)
+}
+
+func (me *GCRARateLimiter) now() int64 {
+	return int64(time.Since(me.epoch))
+}
+
+// Sleeps for d unless ctx or the limiter finishes first
+// Fails straight away if ctx's deadline falls before d elapses
+func (me *GCRARateLimiter) sleep(ctx context.Context, d time.Duration) error {
+	started := time.Now()
+	if deadline, ok := ctx.Deadline(); ok && deadline.Before(started.Add(d)) {
+		return newWaitError(StageRate, started, context.DeadlineExceeded)
+	}
+
+	timer := gcraTimers.Get().(*time.Timer)
+	timer.Reset(d)
+
+	var err error
+	select {
+	case <-timer.C:
+		gcraTimers.Put(timer)
+		return nil
+	case <-me.canceler.Done():
+		err = LimiterStopped
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	// a timer that has already fired may still deliver so only reuse timers stopped in time
+	if timer.Stop() {
+		gcraTimers.Put(timer)
+	}
+	return newWaitError(StageRate, started, err)
+}
+
+// Rounds towards negative infinity unlike the / operator
+func floorDiv(a, b int64) int64 {
+	q := a / b
+	if a%b != 0 && (a < 0) != (b < 0) {
+		q--
+	}
+	return q
+}
+
+// A reservation against a GCRARateLimiter
+type gcraReservation struct {
+	limiter   *GCRARateLimiter
+	tokens    int64
+	timeToAct time.Time
+	canceled  atomic.Bool
+}
+
+var _ Reservation = (*gcraReservation)(nil)
+
+func (me *gcraReservation) OK() bool {
+	return true
+}
+
+func (me *gcraReservation) Delay() time.Duration {
+	if d := time.Until(me.timeToAct); d > 0 {
+		return d
+	}
+	return 0
+}
+
+func (me *gcraReservation) Wait(ctx context.Context) error {
+	if me.limiter.canceler.IsCanceled() {
+		me.Cancel()
+		return newWaitError(StageRate, time.Now(), LimiterStopped)
+	}
+
+	d := me.Delay()
+	if d == 0 {
+		return nil
+	}
+	if err := me.limiter.sleep(ctx, d); err != nil {
+		me.Cancel()
+		return err
+	}
+	return nil
+}
+
+func (me *gcraReservation) Cancel() {
+	if me.canceled.CompareAndSwap(false, true) {
+		me.limiter.refund(me.tokens)
+	}
+}
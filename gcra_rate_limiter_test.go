@@ -0,0 +1,168 @@
+package multilimiter_test
+
+import (
+	"context"
+	"math"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/jrboelens/multilimiter"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestGCRARateLimiterSpec(t *testing.T) {
+
+	Convey("GCRARateLimiter tests ", t, func() {
+		lim := multilimiter.NewGCRARateLimiter(10.0, &multilimiter.BurstOption{Capacity: 3})
+		defer lim.Cancel()
+
+		Convey("allows a burst up to its capacity", func() {
+			So(lim.Remaining(), ShouldEqual, 3)
+			for i := 0; i < 3; i++ {
+				So(lim.Allow(), ShouldBeTrue)
+			}
+			So(lim.Allow(), ShouldBeFalse)
+			So(lim.Remaining(), ShouldEqual, 0)
+		})
+
+		Convey("reports when tokens can next be taken", func() {
+			So(lim.RetryAfter(3), ShouldEqual, 0)
+			So(lim.AllowN(1), ShouldBeTrue)
+			So(lim.RetryAfter(3), ShouldBeBetween, time.Millisecond*90, time.Millisecond*101)
+
+			So(lim.AllowN(2), ShouldBeTrue)
+			So(lim.RetryAfter(2), ShouldBeBetween, time.Millisecond*190, time.Millisecond*201)
+		})
+
+		Convey("Wait spaces tokens by the emission interval", func() {
+			So(lim.WaitN(Context(time.Second), 3), ShouldBeNil)
+
+			started := time.Now()
+			So(lim.Wait(Context(time.Second)), ShouldBeNil)
+			So(time.Since(started), ShouldBeBetween, time.Millisecond*80, time.Millisecond*150)
+		})
+
+		Convey("Wait fails straight away and refunds when the deadline cannot be met", func() {
+			So(lim.WaitN(Context(time.Second), 3), ShouldBeNil)
+
+			started := time.Now()
+			err := lim.Wait(Context(time.Millisecond * 20))
+			So(err, ShouldMatchError, multilimiter.DeadlineExceeded)
+			So(time.Since(started), ShouldBeLessThan, time.Millisecond*10)
+			So(lim.Available(), ShouldEqual, 0)
+		})
+
+		Convey("canceled reservations return their tokens", func() {
+			So(lim.AllowN(3), ShouldBeTrue)
+			reservation := lim.Reserve(2)
+			So(lim.Available(), ShouldEqual, -2)
+
+			reservation.Cancel()
+			reservation.Cancel()
+			So(lim.Available(), ShouldEqual, 0)
+		})
+
+		Convey("Cancel wakes callers blocked in Wait", func() {
+			So(lim.AllowN(3), ShouldBeTrue)
+			go func() {
+				time.Sleep(time.Millisecond * 10)
+				lim.Cancel()
+			}()
+
+			err := lim.WaitN(Context(time.Second), 3)
+			So(err, ShouldMatchError, multilimiter.LimiterStopped)
+			So(lim.Wait(Context(time.Second)), ShouldMatchError, multilimiter.LimiterStopped)
+		})
+
+		Convey("starts with InitialTokensOption tokens", func() {
+			lim := multilimiter.NewGCRARateLimiter(10.0, &multilimiter.BurstOption{Capacity: 3}, &multilimiter.InitialTokensOption{Tokens: 1})
+			So(lim.Available(), ShouldEqual, 1)
+
+			lim = multilimiter.NewGCRARateLimiter(10.0, &multilimiter.BurstOption{Capacity: 3}, &multilimiter.InitialTokensOption{Tokens: 10})
+			So(lim.Available(), ShouldEqual, 3)
+		})
+
+		Convey("rejects requests for more than its capacity", func() {
+			reservation := lim.Reserve(4)
+			So(reservation.OK(), ShouldBeFalse)
+			So(reservation.Wait(Context(time.Second)), ShouldEqual, multilimiter.WeightExceedsLimit)
+			So(lim.WaitN(Context(time.Second), 4), ShouldEqual, multilimiter.WeightExceedsLimit)
+			So(lim.AllowN(4), ShouldBeFalse)
+			So(lim.RetryAfter(4), ShouldBeGreaterThan, time.Hour)
+			So(lim.Available(), ShouldEqual, 3)
+		})
+
+		Convey("caps a capacity whose burst would overflow", func() {
+			lim := multilimiter.NewGCRARateLimiter(1.0, &multilimiter.BurstOption{Capacity: math.MaxInt64})
+			So(lim.Capacity(), ShouldBeGreaterThan, 0)
+			So(lim.Available(), ShouldEqual, lim.Capacity())
+			So(lim.AllowN(lim.Capacity()), ShouldBeTrue)
+			So(lim.Allow(), ShouldBeFalse)
+		})
+
+		Convey("does not limit with a rate <= 0", func() {
+			lim := multilimiter.NewGCRARateLimiter(0)
+			So(lim.WaitN(Context(time.Millisecond), 1000), ShouldBeNil)
+			So(lim.Available(), ShouldEqual, math.MaxInt64)
+			So(lim.Rate(), ShouldEqual, 0)
+		})
+
+		Convey("hands out exactly the burst to concurrent callers", func() {
+			lim := multilimiter.NewGCRARateLimiter(0.001, &multilimiter.BurstOption{Capacity: 10})
+			var allowed int32
+			var wg sync.WaitGroup
+			for i := 0; i < 1000; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					if lim.Allow() {
+						atomic.AddInt32(&allowed, 1)
+					}
+				}()
+			}
+			wg.Wait()
+			So(allowed, ShouldEqual, 10)
+		})
+
+		Convey("does not allocate when taking available tokens", func() {
+			lim := multilimiter.NewGCRARateLimiter(1e9, &multilimiter.BurstOption{Capacity: 1000})
+			ctx := context.Background()
+
+			So(testing.AllocsPerRun(100, func() { lim.Allow() }), ShouldEqual, 0)
+			So(testing.AllocsPerRun(100, func() { lim.Wait(ctx) }), ShouldEqual, 0)
+		})
+
+		Convey("adds no allocations to BasicLimiter.Do", func() {
+			ctx := context.Background()
+			doNothing := func(context.Context) error { return nil }
+			allocs := func(rateLim multilimiter.RateLimiter) float64 {
+				limiter := multilimiter.NewLimiter(
+					&multilimiter.RateLimitOption{Limiter: rateLim},
+					&multilimiter.ConcLimitOption{Limiter: multilimiter.NewConcLimiter(1)},
+				)
+				defer limiter.Stop()
+				return testing.AllocsPerRun(100, func() { limiter.Do(ctx, doNothing) })
+			}
+
+			// whatever Do allocates for itself is the same without a rate limit
+			gcra := multilimiter.NewGCRARateLimiter(1e9, &multilimiter.BurstOption{Capacity: 1000})
+			So(allocs(gcra)-allocs(&multilimiter.NoLimitRateLimiter{}), ShouldEqual, 0)
+		})
+
+		Convey("plugs in through RateLimitOption", func() {
+			limiter := multilimiter.NewLimiter(
+				&multilimiter.RateLimitOption{Limiter: lim},
+				&multilimiter.ConcLimitOption{Limiter: multilimiter.NewConcLimiter(3)},
+			)
+			defer limiter.Stop()
+
+			doNothing := func(context.Context) error { return nil }
+			for i := 0; i < 3; i++ {
+				So(limiter.Do(Context(time.Second), doNothing), ShouldBeNil)
+			}
+			So(limiter.Do(Context(time.Millisecond*20), doNothing), ShouldMatchError, multilimiter.DeadlineExceeded)
+		})
+	})
+}
@@ -1,11 +1,11 @@
 module github.com/jrboelens/multilimiter
 
-go 1.13
+go 1.21
+
+require github.com/smartystreets/goconvey v1.6.4
 
 require (
-	github.com/juju/ratelimit v1.0.1
-	github.com/kr/pretty v0.1.0 // indirect
-	github.com/smartystreets/goconvey v1.6.4
-	github.com/stamblerre/gocode v1.0.0 // indirect
-	gopkg.in/check.v1 v1.0.0-20190902080502-41f04d3bba15 // indirect
+	github.com/gopherjs/gopherjs v0.0.0-20181017120253-0766667cb4d1 // indirect
+	github.com/jtolds/gls v4.20.0+incompatible // indirect
+	github.com/smartystreets/assertions v0.0.0-20180927180507-b2de0cb4f26d // indirect
 )
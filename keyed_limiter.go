@@ -0,0 +1,254 @@
+package multilimiter
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// Creates the limiter used for a key
+// Called lazily the first time a key is seen and again if the key returns after being evicted
+type LimiterFactory func(key string) *BasicLimiter
+
+// Gives every key the same rate and concurrency
+func TemplateFactory(rate float64, concurrency int) LimiterFactory {
+	return func(string) *BasicLimiter {
+		return DefaultLimiter(rate, concurrency)
+	}
+}
+
+// Builds each key's limiter from the options returned by fn
+// fn must return new limiter instances on every call so that keys don't share them
+func OptionsFactory(fn func(key string) []Option) LimiterFactory {
+	return func(key string) *BasicLimiter {
+		return NewLimiter(fn(key)...)
+	}
+}
+
+// Holds a separate BasicLimiter for each key, e.g. per tenant, user or host
+// Idle keys are evicted once they haven't been used for the KeyTTLOption
+// or when room is needed for a new key under the MaxKeysOption
+type KeyedLimiter struct {
+	factory  LimiterFactory
+	ttl      time.Duration
+	maxKeys  int
+	mu       sync.Mutex
+	entries  map[string]*list.Element
+	lru      list.List
+	canceler *Canceler
+}
+
+// A key's limiter along with what's needed to decide when to evict it
+type keyedEntry struct {
+	key      string
+	limiter  *BasicLimiter
+	lastUsed time.Time
+	// callers currently inside Execute() or Do() for the key
+	refs int
+}
+
+func NewKeyedLimiter(factory LimiterFactory, opts ...KeyedOption) *KeyedLimiter {
+	allOpts := createKeyedOptions(opts...)
+
+	return &KeyedLimiter{
+		factory:  factory,
+		ttl:      allOpts.ttl,
+		maxKeys:  allOpts.maxKeys,
+		entries:  map[string]*list.Element{},
+		canceler: NewCanceler(),
+	}
+}
+
+// Executes fn through key's limiter; see Limiter.Execute()
+// The key counts as in use until fn returns
+// KeyLimitReached is returned if a new key cannot be added because every key is busy
+func (me *KeyedLimiter) Execute(ctx context.Context, key string, fn func(context.Context)) error {
+	entry, err := me.checkout(key)
+	if err != nil {
+		return err
+	}
+
+	err = entry.limiter.Execute(ctx, func(ctx context.Context) {
+		defer me.checkin(entry)
+		fn(ctx)
+	})
+	if err != nil {
+		me.checkin(entry)
+	}
+	return err
+}
+
+// Calls fn through key's limiter; see Limiter.Do()
+// KeyLimitReached is returned if a new key cannot be added because every key is busy
+func (me *KeyedLimiter) Do(ctx context.Context, key string, fn func(context.Context) error) error {
+	entry, err := me.checkout(key)
+	if err != nil {
+		return err
+	}
+	defer me.checkin(entry)
+
+	return entry.limiter.Do(ctx, fn)
+}
+
+// Returns key's limiter, creating it if necessary
+// The limiter may be evicted once it is idle so callers should not hold on to it
+func (me *KeyedLimiter) Limiter(key string) (*BasicLimiter, error) {
+	entry, err := me.checkout(key)
+	if err != nil {
+		return nil, err
+	}
+	me.checkin(entry)
+	return entry.limiter, nil
+}
+
+// The number of keys currently held
+func (me *KeyedLimiter) Len() int {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	return len(me.entries)
+}
+
+// Evicts every idle key that has outlived the KeyTTLOption
+// This happens automatically whenever a key is used; calling it directly frees memory sooner
+func (me *KeyedLimiter) Sweep() {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	me.sweep(time.Now())
+}
+
+// Stops every key's limiter; see Limiter.Stop()
+func (me *KeyedLimiter) Stop() {
+	me.canceler.Cancel()
+	for _, lim := range me.limiters() {
+		lim.Stop()
+	}
+}
+
+// Waits for every key's executions to complete; see Limiter.Wait()
+func (me *KeyedLimiter) Wait() error {
+	var errs []error
+	for _, lim := range me.limiters() {
+		errs = append(errs, lim.Wait())
+	}
+	return errors.Join(errs...)
+}
+
+func (me *KeyedLimiter) limiters() []*BasicLimiter {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+
+	limiters := make([]*BasicLimiter, 0, len(me.entries))
+	for _, elem := range me.entries {
+		limiters = append(limiters, elem.Value.(*keyedEntry).limiter)
+	}
+	return limiters
+}
+
+// Finds or creates key's entry and marks it in use
+func (me *KeyedLimiter) checkout(key string) (*keyedEntry, error) {
+	if entry, ok := me.checkoutExisting(key); ok {
+		return entry, nil
+	}
+
+	// the factory may be slow so other keys aren't held up while it runs
+	limiter := me.factory(key)
+
+	me.mu.Lock()
+	defer me.mu.Unlock()
+
+	if me.canceler.IsCanceled() {
+		limiter.Stop()
+		return nil, LimiterStopped
+	}
+	if elem, ok := me.entries[key]; ok {
+		// another caller created the key first
+		limiter.Stop()
+		return me.use(elem), nil
+	}
+	if me.maxKeys > 0 && len(me.entries) >= me.maxKeys && !me.evictOldest() {
+		limiter.Stop()
+		return nil, KeyLimitReached
+	}
+
+	elem := me.lru.PushFront(&keyedEntry{key: key, limiter: limiter})
+	me.entries[key] = elem
+	return me.use(elem), nil
+}
+
+// Marks key's entry in use if the key is already held
+func (me *KeyedLimiter) checkoutExisting(key string) (*keyedEntry, bool) {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+
+	me.sweep(time.Now())
+	elem, ok := me.entries[key]
+	if !ok {
+		return nil, false
+	}
+	return me.use(elem), true
+}
+
+// must be called with mu held
+func (me *KeyedLimiter) use(elem *list.Element) *keyedEntry {
+	entry := elem.Value.(*keyedEntry)
+	entry.refs++
+	entry.lastUsed = time.Now()
+	me.lru.MoveToFront(elem)
+	return entry
+}
+
+func (me *KeyedLimiter) checkin(entry *keyedEntry) {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+
+	entry.refs--
+	entry.lastUsed = time.Now()
+	// busy entries are never evicted so the entry is still in the list
+	me.lru.MoveToFront(me.entries[entry.key])
+}
+
+// Evicts idle entries that have outlived the ttl
+// must be called with mu held
+func (me *KeyedLimiter) sweep(now time.Time) {
+	if me.ttl <= 0 {
+		return
+	}
+
+	// the list is ordered by use so stop at the first entry that is still fresh
+	for elem := me.lru.Back(); elem != nil; {
+		prev := elem.Prev()
+		entry := elem.Value.(*keyedEntry)
+		if now.Sub(entry.lastUsed) < me.ttl {
+			return
+		}
+		if me.isIdle(entry) {
+			me.evict(elem)
+		}
+		elem = prev
+	}
+}
+
+// Evicts the least recently used idle entry
+// must be called with mu held; returns false if every entry is busy
+func (me *KeyedLimiter) evictOldest() bool {
+	for elem := me.lru.Back(); elem != nil; elem = elem.Prev() {
+		if me.isIdle(elem.Value.(*keyedEntry)) {
+			me.evict(elem)
+			return true
+		}
+	}
+	return false
+}
+
+func (me *KeyedLimiter) isIdle(entry *keyedEntry) bool {
+	running, _ := entry.limiter.tasks.counts()
+	return entry.refs == 0 && running == 0
+}
+
+func (me *KeyedLimiter) evict(elem *list.Element) {
+	entry := me.lru.Remove(elem).(*keyedEntry)
+	delete(me.entries, entry.key)
+	entry.limiter.Stop()
+}
@@ -0,0 +1,221 @@
+package multilimiter_test
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/jrboelens/multilimiter"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestKeyedLimiterSpec(t *testing.T) {
+
+	DEFAULT_CONTEXT := func() context.Context {
+		return Context(time.Millisecond * 2000)
+	}
+
+	EmptyExecuteFunc := func(context.Context) {}
+
+	Convey("KeyedLimiter tests ", t, func() {
+
+		Convey("each key has its own limits", func() {
+			lim := multilimiter.NewKeyedLimiter(multilimiter.TemplateFactory(DEFAULT_RATE, 1))
+			defer lim.Stop()
+
+			release := make(chan struct{})
+			So(lim.Execute(DEFAULT_CONTEXT(), "a", func(context.Context) { <-release }), ShouldBeNil)
+
+			// a is saturated but b is not
+			So(lim.Execute(Context(time.Millisecond*20), "a", EmptyExecuteFunc), ShouldMatchError, multilimiter.DeadlineExceeded)
+			So(lim.Execute(Context(time.Millisecond*20), "b", EmptyExecuteFunc), ShouldBeNil)
+
+			close(release)
+			So(lim.Wait(), ShouldBeNil)
+		})
+
+		Convey("limiters are created lazily from the factory", func() {
+			var created []string
+			factory := multilimiter.OptionsFactory(func(key string) []multilimiter.Option {
+				created = append(created, key)
+				return []multilimiter.Option{
+					&multilimiter.ConcLimitOption{Limiter: multilimiter.NewConcLimiter(len(key))},
+					&multilimiter.RateLimitOption{Limiter: multilimiter.NewRateLimiter(0)},
+				}
+			})
+			lim := multilimiter.NewKeyedLimiter(factory)
+			defer lim.Stop()
+			So(lim.Len(), ShouldEqual, 0)
+
+			lim.Do(DEFAULT_CONTEXT(), "ab", func(context.Context) error { return nil })
+			lim.Do(DEFAULT_CONTEXT(), "ab", func(context.Context) error { return nil })
+			lim.Do(DEFAULT_CONTEXT(), "abc", func(context.Context) error { return nil })
+
+			So(created, ShouldResemble, []string{"ab", "abc"})
+			So(lim.Len(), ShouldEqual, 2)
+
+			keyLim, err := lim.Limiter("abc")
+			So(err, ShouldBeNil)
+
+			release := make(chan struct{})
+			defer close(release)
+			for i := 0; i < 3; i++ {
+				So(keyLim.TryExecute(DEFAULT_CONTEXT(), func(context.Context) { <-release }), ShouldBeTrue)
+			}
+			So(keyLim.TryExecute(DEFAULT_CONTEXT(), EmptyExecuteFunc), ShouldBeFalse)
+		})
+
+		Convey("idle keys are evicted after the TTL", func() {
+			ttl := time.Millisecond * 20
+			lim := multilimiter.NewKeyedLimiter(multilimiter.TemplateFactory(DEFAULT_RATE, 1), &multilimiter.KeyTTLOption{TTL: ttl})
+			defer lim.Stop()
+
+			release := make(chan struct{})
+			lim.Execute(DEFAULT_CONTEXT(), "busy", func(context.Context) { <-release })
+			lim.Do(DEFAULT_CONTEXT(), "idle", func(context.Context) error { return nil })
+			time.Sleep(ttl * 2)
+
+			lim.Sweep()
+			So(lim.Len(), ShouldEqual, 1)
+
+			close(release)
+			time.Sleep(ttl)
+			lim.Execute(DEFAULT_CONTEXT(), "new", EmptyExecuteFunc)
+			So(lim.Len(), ShouldEqual, 1)
+		})
+
+		Convey("a key's TTL starts once its task finishes", func() {
+			ttl := time.Millisecond * 20
+			lim := multilimiter.NewKeyedLimiter(multilimiter.TemplateFactory(DEFAULT_RATE, 1), &multilimiter.KeyTTLOption{TTL: ttl})
+			defer lim.Stop()
+
+			release := make(chan struct{})
+			lim.Execute(DEFAULT_CONTEXT(), "slow", func(context.Context) { <-release })
+			time.Sleep(ttl * 2)
+			close(release)
+			lim.Wait()
+
+			lim.Sweep()
+			So(lim.Len(), ShouldEqual, 1)
+
+			time.Sleep(ttl * 2)
+			lim.Sweep()
+			So(lim.Len(), ShouldEqual, 0)
+		})
+
+		Convey("a slow factory does not hold up other keys", func() {
+			release := make(chan struct{})
+			factory := func(key string) *multilimiter.BasicLimiter {
+				if key == "slow" {
+					<-release
+				}
+				return multilimiter.DefaultLimiter(0, 1)
+			}
+			lim := multilimiter.NewKeyedLimiter(factory)
+			defer lim.Stop()
+
+			done := make(chan error)
+			go func() { done <- lim.Do(DEFAULT_CONTEXT(), "slow", func(context.Context) error { return nil }) }()
+			time.Sleep(time.Millisecond * 10)
+
+			So(WaitsWithin(func() {
+				lim.Do(DEFAULT_CONTEXT(), "fast", func(context.Context) error { return nil })
+			}, time.Millisecond*50), ShouldBeTrue)
+
+			close(release)
+			So(<-done, ShouldBeNil)
+			So(lim.Len(), ShouldEqual, 2)
+		})
+
+		Convey("a key created concurrently is only kept once", func() {
+			var created int32
+			factory := func(key string) *multilimiter.BasicLimiter {
+				atomic.AddInt32(&created, 1)
+				time.Sleep(time.Millisecond * 10)
+				return multilimiter.DefaultLimiter(0, 1)
+			}
+			lim := multilimiter.NewKeyedLimiter(factory)
+			defer lim.Stop()
+
+			var wg sync.WaitGroup
+			for i := 0; i < 5; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					lim.Do(DEFAULT_CONTEXT(), "a", func(context.Context) error { return nil })
+				}()
+			}
+			wg.Wait()
+
+			So(lim.Len(), ShouldEqual, 1)
+			So(atomic.LoadInt32(&created), ShouldBeGreaterThanOrEqualTo, 1)
+		})
+
+		Convey("the least recently used idle key is evicted to make room", func() {
+			var created int32
+			factory := func(key string) *multilimiter.BasicLimiter {
+				atomic.AddInt32(&created, 1)
+				return multilimiter.DefaultLimiter(0, 1)
+			}
+			lim := multilimiter.NewKeyedLimiter(factory, &multilimiter.MaxKeysOption{Max: 2})
+			defer lim.Stop()
+
+			for _, key := range []string{"a", "b", "a", "c", "a"} {
+				So(lim.Do(DEFAULT_CONTEXT(), key, func(context.Context) error { return nil }), ShouldBeNil)
+			}
+
+			// b was evicted for c so a was never recreated
+			So(lim.Len(), ShouldEqual, 2)
+			So(atomic.LoadInt32(&created), ShouldEqual, 3)
+		})
+
+		Convey("new keys are rejected when every key is busy", func() {
+			lim := multilimiter.NewKeyedLimiter(multilimiter.TemplateFactory(DEFAULT_RATE, 1), &multilimiter.MaxKeysOption{Max: 1})
+			defer lim.Stop()
+
+			release := make(chan struct{})
+			defer close(release)
+			lim.Execute(DEFAULT_CONTEXT(), "a", func(context.Context) { <-release })
+
+			So(lim.Execute(DEFAULT_CONTEXT(), "b", EmptyExecuteFunc), ShouldEqual, multilimiter.KeyLimitReached)
+		})
+
+		Convey("Stop stops every key", func() {
+			lim := multilimiter.NewKeyedLimiter(multilimiter.TemplateFactory(DEFAULT_RATE, 1))
+			lim.Execute(DEFAULT_CONTEXT(), "a", EmptyExecuteFunc)
+			keyLim, _ := lim.Limiter("a")
+
+			lim.Stop()
+			So(lim.Execute(DEFAULT_CONTEXT(), "a", EmptyExecuteFunc), ShouldMatchError, multilimiter.LimiterStopped)
+			So(keyLim.Execute(DEFAULT_CONTEXT(), EmptyExecuteFunc), ShouldMatchError, multilimiter.LimiterStopped)
+		})
+
+		Convey("is safe for concurrent use", func() {
+			lim := multilimiter.NewKeyedLimiter(multilimiter.TemplateFactory(0, 2),
+				&multilimiter.MaxKeysOption{Max: 5},
+				&multilimiter.KeyTTLOption{TTL: time.Millisecond},
+			)
+			defer lim.Stop()
+
+			var wg sync.WaitGroup
+			var ran int32
+			for i := 0; i < 200; i++ {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					lim.Do(DEFAULT_CONTEXT(), fmt.Sprint(i%10), func(context.Context) error {
+						atomic.AddInt32(&ran, 1)
+						return nil
+					})
+				}(i)
+			}
+			wg.Wait()
+
+			So(atomic.LoadInt32(&ran), ShouldBeGreaterThan, 0)
+			So(lim.Len(), ShouldBeLessThanOrEqualTo, 5)
+		})
+	})
+}
@@ -0,0 +1,156 @@
+package multilimiter
+
+import (
+	"math"
+	"time"
+)
+
+// Calculates a new concurrency limit from a sample of a completed function
+// Implementations are stateful and must not be shared between limiters
+type LimitAlgorithm interface {
+	// Returns the new limit
+	// inflight is the number of slots that were held when the sample's slot was released
+	Update(limit float64, inflight int, rtt time.Duration, dropped bool) float64
+}
+
+// Additive increase, multiplicative decrease
+// The limit grows by one while the limiter is being used and is cut when work is dropped
+type AIMDLimit struct {
+	// Multiplies the limit when work is dropped; defaults to 0.9
+	BackoffRatio float64
+	// Samples slower than Timeout count as dropped; 0 means no timeout
+	Timeout time.Duration
+}
+
+var _ LimitAlgorithm = (*AIMDLimit)(nil)
+
+func (me *AIMDLimit) Update(limit float64, inflight int, rtt time.Duration, dropped bool) float64 {
+	if dropped || (me.Timeout > 0 && rtt > me.Timeout) {
+		backoff := me.BackoffRatio
+		if backoff <= 0 || backoff >= 1 {
+			backoff = 0.9
+		}
+		return limit * backoff
+	}
+
+	// only grow when the current limit is actually being used
+	if float64(inflight)*2 >= limit {
+		return limit + 1
+	}
+	return limit
+}
+
+// Estimates queueing from how far the round trip time has moved from the lowest observed
+// The limit grows while the estimated queue is small and shrinks as it grows
+type VegasLimit struct {
+	// Multiplies the minimum round trip time to smooth out noise; defaults to 1
+	Smoothing float64
+	minRtt    time.Duration
+}
+
+var _ LimitAlgorithm = (*VegasLimit)(nil)
+
+func (me *VegasLimit) Update(limit float64, inflight int, rtt time.Duration, dropped bool) float64 {
+	if rtt <= 0 {
+		return limit
+	}
+	if me.minRtt == 0 || rtt < me.minRtt {
+		me.minRtt = rtt
+	}
+
+	logLimit := math.Max(1, math.Log10(limit))
+	if dropped {
+		return limit - logLimit
+	}
+
+	// avoid growing while the limiter isn't being used
+	if float64(inflight)*2 < limit {
+		return limit
+	}
+
+	smoothing := me.Smoothing
+	if smoothing <= 0 {
+		smoothing = 1
+	}
+	queueSize := math.Ceil(limit * (1 - float64(me.minRtt)*smoothing/float64(rtt)))
+
+	alpha := 3 * logLimit
+	beta := 6 * logLimit
+	switch {
+	case queueSize <= logLimit:
+		return limit + beta
+	case queueSize < alpha:
+		return limit + logLimit
+	case queueSize > beta:
+		return limit - logLimit
+	}
+	return limit
+}
+
+// Compares a short term round trip time against a long term average
+// The limit shrinks as the short term rises above the long term and grows by a queue allowance otherwise
+type Gradient2Limit struct {
+	// How far the short term may rise above the long term before shrinking; defaults to 1.5
+	Tolerance float64
+	// The number of samples in the long term average; defaults to 600
+	LongWindow int
+	// How much of each new limit is blended into the current one; defaults to 0.2
+	Smoothing float64
+	// Extra slots allowed on top of the gradient; defaults to the square root of the limit
+	QueueSize func(limit float64) float64
+	longRtt   float64
+	samples   int
+}
+
+var _ LimitAlgorithm = (*Gradient2Limit)(nil)
+
+func (me *Gradient2Limit) Update(limit float64, inflight int, rtt time.Duration, dropped bool) float64 {
+	if rtt <= 0 {
+		return limit
+	}
+	shortRtt := float64(rtt)
+
+	window := me.LongWindow
+	if window <= 0 {
+		window = 600
+	}
+	// warm the long term average up with a plain mean before switching to an exponential one
+	if me.samples < window {
+		me.samples++
+		me.longRtt += (shortRtt - me.longRtt) / float64(me.samples)
+	} else {
+		factor := 2 / float64(window+1)
+		me.longRtt = me.longRtt*(1-factor) + shortRtt*factor
+	}
+
+	// let the long term average drift back down after a sustained spike
+	if me.longRtt/shortRtt > 2 {
+		me.longRtt *= 0.95
+	}
+
+	// avoid growing while the limiter isn't being used
+	if !dropped && float64(inflight) < limit/2 {
+		return limit
+	}
+
+	tolerance := me.Tolerance
+	if tolerance <= 0 {
+		tolerance = 1.5
+	}
+	gradient := math.Max(0.5, math.Min(1, tolerance*me.longRtt/shortRtt))
+	if dropped {
+		gradient = 0.5
+	}
+
+	queueSize := math.Sqrt(limit)
+	if me.QueueSize != nil {
+		queueSize = me.QueueSize(limit)
+	}
+
+	smoothing := me.Smoothing
+	if smoothing <= 0 || smoothing > 1 {
+		smoothing = 0.2
+	}
+	newLimit := limit*gradient + queueSize
+	return limit*(1-smoothing) + newLimit*smoothing
+}
@@ -0,0 +1,82 @@
+package multilimiter_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/jrboelens/multilimiter"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestLimitAlgorithmSpec(t *testing.T) {
+
+	rtt := 10 * time.Millisecond
+
+	Convey("LimitAlgorithm tests ", t, func() {
+
+		Convey("AIMDLimit", func() {
+			algo := &multilimiter.AIMDLimit{}
+
+			Convey("grows by one while the limit is being used", func() {
+				So(algo.Update(10, 5, rtt, false), ShouldEqual, 11)
+			})
+
+			Convey("holds while the limit is mostly unused", func() {
+				So(algo.Update(10, 2, rtt, false), ShouldEqual, 10)
+			})
+
+			Convey("backs off when work is dropped", func() {
+				So(algo.Update(10, 10, rtt, true), ShouldEqual, 9)
+			})
+
+			Convey("treats slow samples as dropped", func() {
+				algo := &multilimiter.AIMDLimit{BackoffRatio: 0.5, Timeout: rtt}
+				So(algo.Update(10, 10, rtt*2, false), ShouldEqual, 5)
+			})
+		})
+
+		Convey("VegasLimit", func() {
+			algo := &multilimiter.VegasLimit{}
+
+			Convey("grows while round trip times stay at the minimum", func() {
+				limit := 10.0
+				for i := 0; i < 5; i++ {
+					limit = algo.Update(limit, int(limit), rtt, false)
+				}
+				So(limit, ShouldBeGreaterThan, 10)
+			})
+
+			Convey("shrinks when round trip times rise", func() {
+				algo.Update(20, 20, rtt, false)
+				So(algo.Update(20, 20, rtt*10, false), ShouldBeLessThan, 20)
+			})
+
+			Convey("shrinks when work is dropped", func() {
+				So(algo.Update(20, 20, rtt, true), ShouldBeLessThan, 20)
+			})
+		})
+
+		Convey("Gradient2Limit", func() {
+			algo := &multilimiter.Gradient2Limit{}
+
+			Convey("grows while round trip times are steady", func() {
+				limit := 10.0
+				for i := 0; i < 20; i++ {
+					limit = algo.Update(limit, int(limit), rtt, false)
+				}
+				So(limit, ShouldBeGreaterThan, 10)
+			})
+
+			Convey("shrinks when round trip times rise above the long term", func() {
+				limit := 50.0
+				for i := 0; i < 100; i++ {
+					algo.Update(limit, int(limit), rtt, false)
+				}
+				for i := 0; i < 10; i++ {
+					limit = algo.Update(limit, int(limit), rtt*10, false)
+				}
+				So(limit, ShouldBeLessThan, 50)
+			})
+		})
+	})
+}
@@ -2,22 +2,27 @@ package multilimiter
 
 import (
 	"context"
-	"fmt"
-	"io"
-	"os"
+	"errors"
 	"runtime/debug"
+	"sync"
+	"time"
 )
 
 type Limiter interface {
 	// Stops the limiter
 	Stop()
 	// Waits for all executions to complete before returning
-	Wait()
+	// Panics collected while running under PanicCollect are returned
+	Wait() error
 	// Once available time or concurrency becomes available
 	// execute function fn in a go routine
-	// DeadlineExceeded is returned if the timeout elapses before rate and concurrency slots can be acquired
+	// An error matching DeadlineExceeded is returned if the timeout elapses before rate and concurrency slots can be acquired
 	// fn's implementer can choose whether to adhere to the Context parameter's Doneness
 	Execute(ctx context.Context, fn func(context.Context)) error
+	// Once available time or concurrency becomes available
+	// execute function fn in the calling go routine and return its error
+	// An error matching DeadlineExceeded is returned if the timeout elapses before rate and concurrency slots can be acquired
+	Do(ctx context.Context, fn func(context.Context) error) error
 }
 
 // Ensure the Limiter implementation always meets the MultiLimiter interface
@@ -28,78 +33,505 @@ type BasicLimiter struct {
 	allOpts     *options
 	concLimiter ConcLimiter
 	rateLimiter RateLimiter
+	parent      *BasicLimiter
+	queue       *admissionQueue
+	observer    Observer
 	canceler    *Canceler
+	lifetime    context.Context
+	endLifetime context.CancelFunc
+	tasks       *taskGroup
+	panicsMu    sync.Mutex
+	panics      []error
 }
 
 func NewLimiter(opts ...Option) *BasicLimiter {
 	// Add validation here
 
 	allOpts := CreateOptions(opts...)
+	lifetime, endLifetime := context.WithCancel(context.Background())
+
+	rateLimiter := allOpts.rateLimit[0]
+	if len(allOpts.rateLimit) > 1 {
+		rateLimiter = NewCompositeRateLimiter(allOpts.rateLimit...)
+	}
 
 	return &BasicLimiter{
 		allOpts:     allOpts,
 		concLimiter: allOpts.concLimit.Limiter,
-		rateLimiter: allOpts.rateLimit.Limiter,
+		rateLimiter: rateLimiter,
+		parent:      allOpts.parent.Limiter,
+		queue:       newAdmissionQueue(allOpts.queueLength, allOpts.queueTimeout),
+		observer:    newObserver(allOpts.observers),
 		canceler:    NewCanceler(),
+		lifetime:    lifetime,
+		endLifetime: endLifetime,
+		tasks:       newTaskGroup(),
 	}
 }
 
 func DefaultLimiter(rate float64, concurrency int) *BasicLimiter {
 	rateOpt := &RateLimitOption{NewRateLimiter(rate)}
 	concOpt := &ConcLimitOption{NewConcLimiter(concurrency)}
-	return NewLimiter(rateOpt, concOpt)
+	lim := NewLimiter(rateOpt, concOpt)
+	lim.allOpts.ownsRate, lim.allOpts.ownsConc = true, true
+	return lim
 }
 
-// Stops the limiter
+// Stops the limiter; blocked callers return LimiterStopped
+// The concurrency and rate limiters are canceled too, but only if the limiter created them itself
+// Limiters passed in through ConcLimitOption, RateLimitOption or ParentOption may be shared so they are left running
+// Functions that are already running are left to finish unless TaskContextOption.CancelOnStop is set
 func (me *BasicLimiter) Stop() {
-	me.canceler.Cancel()
+	alreadyStopped := me.canceler.Cancel()
+	me.endLifetime()
+	if me.allOpts.ownsConc {
+		me.concLimiter.Cancel()
+	}
+	if me.allOpts.ownsRate {
+		me.rateLimiter.Cancel()
+	}
+	if !alreadyStopped {
+		me.observer.OnStop()
+	}
+}
+
+// How many functions BasicLimiter.Shutdown() waited for and how many it gave up on
+type ShutdownSummary struct {
+	// The number of functions that finished after shutdown began
+	Drained int
+	// The number of functions still running when shutdown returned
+	Abandoned int
+}
+
+// Stops the limiter and waits for running functions to finish
+// The summary is always returned; if ctx is done before everything finished
+// a *ShutdownError carrying the same summary is returned too
+func (me *BasicLimiter) Shutdown(ctx context.Context) (ShutdownSummary, error) {
+	me.Stop()
+	_, finishedAtStop := me.tasks.counts()
+
+	select {
+	case <-me.tasks.idleCh():
+		_, finished := me.tasks.counts()
+		return ShutdownSummary{Drained: finished - finishedAtStop}, nil
+	case <-ctx.Done():
+		running, finished := me.tasks.counts()
+		summary := ShutdownSummary{Drained: finished - finishedAtStop, Abandoned: running}
+		return summary, &ShutdownError{ShutdownSummary: summary, Err: ctx.Err()}
+	}
+}
+
+// The concurrency of the configured concurrency limiter
+func (me *BasicLimiter) Concurrency() int {
+	return me.concLimiter.Concurrency()
+}
+
+// The rate of the configured rate limiter in tokens per second
+func (me *BasicLimiter) Rate() float64 {
+	return me.rateLimiter.Rate()
 }
 
 // Waits for all executions to complete before returning
-func (me *BasicLimiter) Wait() {
+// Panics collected while running under PanicCollect are returned and cleared
+func (me *BasicLimiter) Wait() error {
 	me.concLimiter.Wait()
+
+	me.panicsMu.Lock()
+	defer me.panicsMu.Unlock()
+	err := errors.Join(me.panics...)
+	me.panics = nil
+	return err
 }
 
 // Once available time or concurrency becomes available
 // execute function fn in a go routine
-// DeadlineExceeded is returned if the timeout elapses before rate and concurrency slots can be acquired
+// An error matching DeadlineExceeded is returned if the timeout elapses before rate and concurrency slots can be acquired
+// A panic in fn is handled according to the configured PanicOption
 func (me *BasicLimiter) Execute(ctx context.Context, fn func(context.Context)) error {
+	return me.ExecuteN(ctx, 1, 1, fn)
+}
+
+// Behaves like Execute() but consumes cost rate tokens and weight concurrency slots
+// Use this when a single call represents more than one unit of work
+func (me *BasicLimiter) ExecuteN(ctx context.Context, cost int64, weight int, fn func(context.Context)) error {
 	if me.canceler.IsCanceled() {
-		return LimiterStopped
+		return me.reject(LimiterStopped)
 	}
 
-	// wait for a slot from the concurrency pool
-	slot, err := me.concLimiter.Acquire(ctx)
+	slot, err := me.acquire(ctx, cost, weight)
 	if err != nil {
 		return err
 	}
 
-	// wait for a token from the rate limiter
-	if err := me.rateLimiter.Wait(ctx); err != nil {
-		return err
+	me.goExecute(ctx, slot, fn)
+	return nil
+}
+
+// Executes fn in a go routine if rate and concurrency are available right now
+// Returns false without consuming anything if either is unavailable or the limiter is stopped
+func (me *BasicLimiter) TryExecute(ctx context.Context, fn func(context.Context)) bool {
+	if me.canceler.IsCanceled() {
+		me.reject(LimiterStopped)
+		return false
 	}
 
+	slot, ok := me.tryAcquire(false)
+	if !ok {
+		return false
+	}
+
+	me.goExecute(ctx, slot, fn)
+	return true
+}
+
+// Runs fn in a go routine, releasing slot once it completes
+func (me *BasicLimiter) goExecute(ctx context.Context, slot Slot, fn func(context.Context)) {
 	go func() {
+		taskCtx, run := me.startTask(ctx, slot)
+		panicked := true
+		// deferred first so that the slot is released even if the PanicHandler panics
+		defer func() { run.finish(panicked, nil) }()
 		defer func() {
 			r := recover()
-			//			me.concLimiter.Release()
-			slot.Release()
-			if r != nil {
-				OutStream.Write([]byte(fmt.Sprintf("Panic found in BasicLimiter: %s\n", r)))
-				OutStream.Write(debug.Stack())
+			if r == nil {
+				return
+			}
+			me.handlePanic(ctx, r, debug.Stack())
+			if me.allOpts.panic.Mode == PanicCrash {
 				panic(r)
 			}
 		}()
 
-		fn(ctx)
+		fn(taskCtx)
+		panicked = false
 	}()
-	return nil
 }
 
-// If Limiter.Execute() panicks the stack trace will be sent down OutStream
-// The default value is os.Stdout
-var OutStream io.Writer
+// Derives the context passed to a function from ctx according to the TaskContextOption
+// The returned taskRun must be finished once the function returns
+func (me *BasicLimiter) startTask(ctx context.Context, slot Slot) (context.Context, *taskRun) {
+	opt := me.allOpts.taskCtx
+	run := &taskRun{slot: slot, classifier: me.allOpts.outcome.Classifier, limiter: me}
+
+	if opt.Detach {
+		ctx = context.WithoutCancel(ctx)
+	}
+	if opt.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, opt.Timeout)
+		run.cleanup = append(run.cleanup, cancel)
+	}
+	if opt.CancelOnStop {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithCancel(ctx)
+		stop := context.AfterFunc(me.lifetime, cancel)
+		run.cleanup = append(run.cleanup, func() { stop() }, cancel)
+	}
+
+	ctx = context.WithValue(ctx, outcomeKey{}, &run.outcome)
+	run.started = time.Now()
+	// parents are told about work admitted through their children as if it were their own
+	for lim := me; lim != nil; lim = lim.parent {
+		lim.observer.OnTaskStart()
+	}
+	return ctx, run
+}
+
+// Applies the configured PanicMode to a panic recovered from Execute()
+// PanicCrash is completed by the caller; its slot is still released as the panic unwinds
+func (me *BasicLimiter) handlePanic(ctx context.Context, r interface{}, stack []byte) {
+	opt := me.allOpts.panic
+	switch {
+	case opt.Mode == PanicHandle && opt.Handler != nil:
+		opt.Handler(ctx, r, stack)
+	case opt.Mode == PanicCollect:
+		me.panicsMu.Lock()
+		me.panics = append(me.panics, &PanicError{Value: r, Stack: stack})
+		me.panicsMu.Unlock()
+	default:
+		me.allOpts.log.Logger.Printf("Panic found in BasicLimiter: %v\n%s", r, stack)
+	}
+}
+
+// Once available time or concurrency becomes available
+// execute function fn in the calling go routine and return its error
+// The slot is released as soon as fn returns, even if fn panics
+// An error matching DeadlineExceeded is returned if the timeout elapses before rate and concurrency slots can be acquired
+func (me *BasicLimiter) Do(ctx context.Context, fn func(context.Context) error) error {
+	if me.canceler.IsCanceled() {
+		return me.reject(LimiterStopped)
+	}
+
+	slot, err := me.acquire(ctx, 1, 1)
+	if err != nil {
+		return err
+	}
+
+	taskCtx, run := me.startTask(ctx, slot)
+	panicked := true
+	defer func() { run.finish(panicked, err) }()
+
+	err = fn(taskCtx)
+	panicked = false
+	return err
+}
+
+// Once available time or concurrency becomes available
+// execute function fn in a go routine and return a Future for its result
+// Acquisition errors are reported through the returned Future's Err()
+// A panic in fn is recovered and reported as a *PanicError regardless of the PanicOption
+func (me *BasicLimiter) Submit(ctx context.Context, fn func(context.Context) (interface{}, error)) *Future {
+	if me.canceler.IsCanceled() {
+		return failedFuture(me.reject(LimiterStopped))
+	}
+
+	slot, err := me.acquire(ctx, 1, 1)
+	if err != nil {
+		return failedFuture(err)
+	}
+
+	future := newFuture()
+	go func() {
+		var result interface{}
+		var err error
+		taskCtx, run := me.startTask(ctx, slot)
+		panicked := true
+		defer func() { future.complete(result, err) }()
+		defer func() { run.finish(panicked, err) }()
+		defer func() {
+			if r := recover(); r != nil {
+				err = &PanicError{Value: r, Stack: debug.Stack()}
+			}
+		}()
+
+		result, err = fn(taskCtx)
+		panicked = false
+	}()
+	return future
+}
+
+// Executes fn through lim.Do() and returns its result
+// The zero value of T is returned if rate and concurrency slots cannot be acquired
+func Call[T any](ctx context.Context, lim Limiter, fn func(context.Context) (T, error)) (T, error) {
+	var result T
+	err := lim.Do(ctx, func(ctx context.Context) error {
+		var err error
+		result, err = fn(ctx)
+		return err
+	})
+	return result, err
+}
+
+// Acquires weight concurrency slots and cost rate tokens from each parent in turn
+// and then from this limiter
+// Acquisition is transactional: if a later stage fails the stages already acquired are rolled back
+// ErrQueueFull is returned if the caller is shed by the MaxQueueLengthOption
+func (me *BasicLimiter) acquire(ctx context.Context, cost int64, weight int) (*taskSlot, error) {
+	return me.admit(ctx, cost, weight, false)
+}
+
+// Acquires like acquire()
+// if revocable the tokens are kept as a Reservation so that cancel() can return them,
+// which a child needs of its parent but nobody else does
+func (me *BasicLimiter) admit(ctx context.Context, cost int64, weight int, revocable bool) (*taskSlot, error) {
+	me.observer.OnAcquireStart()
+	started := time.Now()
 
-func init() {
-	OutStream = os.Stdout
+	waitCtx, done := me.stoppable(ctx)
+	slot, err := me.acquireQueued(waitCtx, cost, weight, revocable)
+	if err != nil && context.Cause(waitCtx) == LimiterStopped {
+		err = stoppedWhileWaiting(err)
+	}
+	done()
+	if err != nil {
+		return nil, me.reject(err)
+	}
+	me.observer.OnAcquire(time.Since(started))
+	return slot, nil
+}
+
+// Ties ctx to the limiter's lifetime so that Stop() wakes callers blocked on limiters it doesn't cancel
+// The returned func must be called once done waiting
+func (me *BasicLimiter) stoppable(ctx context.Context) (context.Context, func()) {
+	if me.allOpts.ownsConc && me.allOpts.ownsRate && me.parent == nil {
+		// Stop() cancels every limiter a caller can block on
+		return ctx, func() {}
+	}
+
+	ctx, cancel := context.WithCancelCause(ctx)
+	stop := context.AfterFunc(me.lifetime, func() { cancel(LimiterStopped) })
+	return ctx, func() {
+		stop()
+		cancel(nil)
+	}
+}
+
+// Reports a wait that was cut short by Stop() as LimiterStopped
+func stoppedWhileWaiting(err error) error {
+	if waitErr, ok := err.(*WaitError); ok {
+		waitErr.Err = LimiterStopped
+		return waitErr
+	}
+	return LimiterStopped
+}
+
+// Waits in the queue, if there is one, while acquiring
+func (me *BasicLimiter) acquireQueued(ctx context.Context, cost int64, weight int, revocable bool) (*taskSlot, error) {
+	if me.queue == nil {
+		return me.acquireStages(ctx, cost, weight, revocable)
+	}
+
+	queueCtx, leave, err := me.queue.enter(ctx)
+	if err != nil {
+		return nil, err
+	}
+	slot, err := me.acquireStages(queueCtx, cost, weight, revocable)
+	if err != nil && context.Cause(queueCtx) == ErrQueueFull {
+		err = ErrQueueFull
+	}
+	leave(err == nil)
+	return slot, err
+}
+
+// Parents are acquired first so that a saturated parent doesn't leave callers holding the child's capacity
+func (me *BasicLimiter) acquireStages(ctx context.Context, cost int64, weight int, revocable bool) (*taskSlot, error) {
+	var parent *taskSlot
+	if me.parent != nil {
+		var err error
+		if parent, err = me.parent.admit(ctx, cost, weight, true); err != nil {
+			return nil, err
+		}
+	}
+
+	// wait for a slot from the concurrency pool
+	slot, err := me.concLimiter.AcquireN(ctx, weight)
+	if err != nil {
+		parent.cancel()
+		return nil, err
+	}
+
+	// wait for tokens from the rate limiter; a failed wait refunds them so that neither stage loses capacity
+	// the rate is the last stage so a Reservation is only needed when a child may yet roll it back
+	var reservation Reservation
+	if revocable {
+		reservation = me.rateLimiter.Reserve(cost)
+		err = reservation.Wait(ctx)
+	} else {
+		err = me.rateLimiter.WaitN(ctx, cost)
+	}
+	if err != nil {
+		// return the slot so that failed acquisitions do not drain the pool
+		slot.Release()
+		parent.cancel()
+		return nil, err
+	}
+
+	return me.track(slot, reservation, parent), nil
+}
+
+// Acquires a slot and a token from this limiter and each parent without waiting
+// The observer is told about the attempt as if the caller had waited for no time at all
+// revocable works as it does for admit()
+func (me *BasicLimiter) tryAcquire(revocable bool) (*taskSlot, bool) {
+	me.observer.OnAcquireStart()
+	slot, ok := me.tryStages(revocable)
+	if !ok {
+		me.observer.OnReject(RejectUnavailable, nil)
+		return nil, false
+	}
+	me.observer.OnAcquire(0)
+	return slot, true
+}
+
+// Nothing is held unless every level has capacity right now
+func (me *BasicLimiter) tryStages(revocable bool) (*taskSlot, bool) {
+	// a slot is cheap to give back so check for one before taking anything from the parent
+	slot, ok := me.concLimiter.TryAcquire()
+	if !ok {
+		return nil, false
+	}
+
+	var parent *taskSlot
+	if me.parent != nil {
+		if parent, ok = me.parent.tryAcquire(true); !ok {
+			slot.Release()
+			return nil, false
+		}
+	}
+
+	// a token spent by Allow() can't be given back so a child may still need to roll this one back
+	var reservation Reservation
+	if revocable {
+		reservation = me.rateLimiter.Reserve(1)
+		if ok = reservation.OK() && reservation.Delay() == 0; !ok {
+			reservation.Cancel()
+		}
+	} else {
+		ok = me.rateLimiter.Allow()
+	}
+	if !ok {
+		slot.Release()
+		parent.cancel()
+		return nil, false
+	}
+
+	return me.track(slot, reservation, parent), true
+}
+
+// Tells the observer why a caller was turned away and returns err
+func (me *BasicLimiter) reject(err error) error {
+	me.observer.OnReject(RejectReasonOf(err), err)
+	return err
+}
+
+// Counts the holder of slot as a running function until the slot is released
+// reservation, if any, holds the tokens taken for it and parent what it holds against the parent
+func (me *BasicLimiter) track(slot Slot, reservation Reservation, parent *taskSlot) *taskSlot {
+	me.tasks.start()
+	return &taskSlot{Slot: slot, reservation: reservation, parent: parent, tasks: me.tasks}
+}
+
+// A slot held by a running function along with whatever it holds against its limiter's parents
+type taskSlot struct {
+	Slot
+	reservation Reservation
+	parent      *taskSlot
+	tasks       *taskGroup
+	once        sync.Once
+}
+
+func (me *taskSlot) Release() {
+	me.once.Do(func() {
+		me.Slot.Release()
+		me.tasks.done()
+		if me.parent != nil {
+			me.parent.Release()
+		}
+	})
+}
+
+func (me *taskSlot) ReleaseWithResult(rtt time.Duration, dropped bool) {
+	me.once.Do(func() {
+		me.Slot.ReleaseWithResult(rtt, dropped)
+		me.tasks.done()
+		if me.parent != nil {
+			me.parent.ReleaseWithResult(rtt, dropped)
+		}
+	})
+}
+
+// Gives back a slot whose function never ran, returning its tokens where possible
+// Safe to call on a nil taskSlot
+func (me *taskSlot) cancel() {
+	if me == nil {
+		return
+	}
+	me.once.Do(func() {
+		if me.reservation != nil {
+			me.reservation.Cancel()
+		}
+		me.Slot.Release()
+		me.tasks.done()
+		me.parent.cancel()
+	})
 }
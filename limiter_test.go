@@ -1,7 +1,14 @@
 package multilimiter_test
 
 import (
+	"bytes"
 	"context"
+	"errors"
+	"log"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -39,7 +46,653 @@ func TestLimiterSpec(t *testing.T) {
 			lim.Stop()
 
 			err := lim.Execute(DEFAULT_CONTEXT(), EmptyExecuteFunc)
-			So(err, ShouldEqual, multilimiter.LimiterStopped)
+			So(err, ShouldMatchError, multilimiter.LimiterStopped)
+		})
+
+		Convey("Stop wakes callers blocked on the concurrency limiter", func() {
+			lim := NewBasicLimiter(DEFAULT_RATE, 1)
+
+			release := make(chan struct{})
+			defer close(release)
+			lim.Execute(DEFAULT_CONTEXT(), func(context.Context) { <-release })
+
+			go func() {
+				time.Sleep(time.Millisecond * 20)
+				lim.Stop()
+			}()
+
+			start := time.Now()
+			err := lim.Execute(Context(time.Second*5), EmptyExecuteFunc)
+			So(err, ShouldMatchError, multilimiter.LimiterStopped)
+			So(time.Since(start), ShouldBeLessThan, time.Second)
+		})
+
+		Convey("Stop leaves limiters that were passed in running", func() {
+			sharedConc := multilimiter.NewConcLimiter(1)
+			sharedRate := multilimiter.NewRateLimiter(DEFAULT_RATE)
+			newSibling := func() *multilimiter.BasicLimiter {
+				return multilimiter.NewLimiter(
+					&multilimiter.ConcLimitOption{Limiter: sharedConc},
+					&multilimiter.RateLimitOption{Limiter: sharedRate},
+				)
+			}
+			a, b := newSibling(), newSibling()
+			defer b.Stop()
+
+			Convey("so that siblings keep working", func() {
+				a.Stop()
+				So(a.Do(DEFAULT_CONTEXT(), func(context.Context) error { return nil }), ShouldMatchError, multilimiter.LimiterStopped)
+				So(b.Do(DEFAULT_CONTEXT(), func(context.Context) error { return nil }), ShouldBeNil)
+			})
+
+			Convey("but still wakes its own blocked callers", func() {
+				release := make(chan struct{})
+				b.Execute(DEFAULT_CONTEXT(), func(context.Context) { <-release })
+				go func() {
+					time.Sleep(time.Millisecond * 20)
+					a.Stop()
+				}()
+
+				start := time.Now()
+				err := a.Execute(Context(time.Second*5), EmptyExecuteFunc)
+				So(err, ShouldMatchError, multilimiter.LimiterStopped)
+				So(errors.Is(err, multilimiter.DeadlineExceeded), ShouldBeFalse)
+				So(time.Since(start), ShouldBeLessThan, time.Second)
+
+				close(release)
+				So(b.Do(DEFAULT_CONTEXT(), func(context.Context) error { return nil }), ShouldBeNil)
+			})
+		})
+
+		Convey("Shutdown", func() {
+			Convey("waits for running functions to drain", func() {
+				lim := NewBasicLimiter(DEFAULT_RATE, 2)
+				var finished int32
+				for i := 0; i < 2; i++ {
+					lim.Execute(DEFAULT_CONTEXT(), func(context.Context) {
+						time.Sleep(time.Millisecond * 30)
+						atomic.AddInt32(&finished, 1)
+					})
+				}
+
+				summary, err := lim.Shutdown(DEFAULT_CONTEXT())
+				So(err, ShouldBeNil)
+				So(summary, ShouldResemble, multilimiter.ShutdownSummary{Drained: 2})
+				So(atomic.LoadInt32(&finished), ShouldEqual, 2)
+
+				So(lim.Execute(DEFAULT_CONTEXT(), EmptyExecuteFunc), ShouldMatchError, multilimiter.LimiterStopped)
+			})
+
+			Convey("reports drained and abandoned functions when the deadline passes", func() {
+				lim := multilimiter.NewLimiter(
+					&multilimiter.RateLimitOption{Limiter: multilimiter.NewRateLimiter(DEFAULT_RATE, &multilimiter.BurstOption{Capacity: 10})},
+					&multilimiter.ConcLimitOption{Limiter: multilimiter.NewConcLimiter(3)},
+				)
+				release := make(chan struct{})
+				defer close(release)
+
+				lim.Execute(DEFAULT_CONTEXT(), func(context.Context) { time.Sleep(time.Millisecond * 10) })
+				lim.Execute(DEFAULT_CONTEXT(), func(context.Context) { <-release })
+				lim.Do(DEFAULT_CONTEXT(), func(context.Context) error { return nil })
+				So(lim.TryExecute(DEFAULT_CONTEXT(), func(context.Context) { <-release }), ShouldBeTrue)
+
+				summary, err := lim.Shutdown(Context(time.Millisecond * 50))
+				So(summary, ShouldResemble, multilimiter.ShutdownSummary{Drained: 1, Abandoned: 2})
+
+				var shutdownErr *multilimiter.ShutdownError
+				So(errors.As(err, &shutdownErr), ShouldBeTrue)
+				So(shutdownErr.Drained, ShouldEqual, 1)
+				So(shutdownErr.Abandoned, ShouldEqual, 2)
+				So(err, ShouldMatchError, context.DeadlineExceeded)
+			})
+		})
+
+		Convey("TaskContextOption", func() {
+			// returns the error of the context fn received once fn returns
+			RunWith := func(opt *multilimiter.TaskContextOption, ctx context.Context, fn func(context.Context)) (*multilimiter.BasicLimiter, chan error) {
+				lim := multilimiter.NewLimiter(opt)
+				errs := make(chan error, 1)
+				err := lim.Execute(ctx, func(ctx context.Context) {
+					fn(ctx)
+					errs <- ctx.Err()
+				})
+				So(err, ShouldBeNil)
+				return lim, errs
+			}
+
+			Convey("passes the caller's context by default", func() {
+				ctx, cancel := ContextWithCancel(0)
+				_, errs := RunWith(&multilimiter.TaskContextOption{}, ctx, func(ctx context.Context) {
+					cancel()
+					<-ctx.Done()
+				})
+				So(<-errs, ShouldMatchError, context.Canceled)
+			})
+
+			Convey("Timeout limits how long the function may run", func() {
+				_, errs := RunWith(&multilimiter.TaskContextOption{Timeout: time.Millisecond * 20}, DEFAULT_CONTEXT(), func(ctx context.Context) {
+					<-ctx.Done()
+				})
+				So(<-errs, ShouldMatchError, context.DeadlineExceeded)
+			})
+
+			Convey("Detach ignores the caller's deadline", func() {
+				_, errs := RunWith(&multilimiter.TaskContextOption{Detach: true}, Context(time.Millisecond*10), func(ctx context.Context) {
+					time.Sleep(time.Millisecond * 30)
+				})
+				So(<-errs, ShouldBeNil)
+			})
+
+			Convey("Detach can be combined with a Timeout", func() {
+				opt := &multilimiter.TaskContextOption{Detach: true, Timeout: time.Millisecond * 50}
+				_, errs := RunWith(opt, Context(time.Millisecond*10), func(ctx context.Context) {
+					<-ctx.Done()
+				})
+				So(<-errs, ShouldMatchError, context.DeadlineExceeded)
+			})
+
+			Convey("CancelOnStop cancels running functions when the limiter stops", func() {
+				started := make(chan struct{})
+				lim, errs := RunWith(&multilimiter.TaskContextOption{CancelOnStop: true}, DEFAULT_CONTEXT(), func(ctx context.Context) {
+					close(started)
+					<-ctx.Done()
+				})
+				<-started
+				lim.Stop()
+				So(<-errs, ShouldMatchError, context.Canceled)
+			})
+
+			Convey("applies to Do", func() {
+				lim := multilimiter.NewLimiter(&multilimiter.TaskContextOption{Detach: true})
+				err := lim.Do(Context(time.Millisecond*10), func(ctx context.Context) error {
+					time.Sleep(time.Millisecond * 30)
+					return ctx.Err()
+				})
+				So(err, ShouldBeNil)
+			})
+		})
+
+		Convey("Do", func() {
+			Convey("runs fn in the calling go routine and returns its error", func() {
+				lim := NewDefaultLimiter()
+				defer lim.Stop()
+
+				expected := errors.New("failed")
+				ran := false
+				err := lim.Do(DEFAULT_CONTEXT(), func(context.Context) error {
+					ran = true
+					return expected
+				})
+				So(ran, ShouldBeTrue)
+				So(err, ShouldEqual, expected)
+			})
+
+			Convey("releases the slot when fn returns", func() {
+				concLim := multilimiter.NewConcLimiter(1)
+				lim := multilimiter.NewLimiter(&multilimiter.ConcLimitOption{Limiter: concLim})
+				defer lim.Stop()
+
+				for i := 0; i < 3; i++ {
+					err := lim.Do(DEFAULT_CONTEXT(), func(context.Context) error { return nil })
+					So(err, ShouldBeNil)
+				}
+				So(WaitsWithin(func() { lim.Wait() }, time.Second), ShouldBeTrue)
+			})
+
+			Convey("releases the slot when fn panics", func() {
+				lim := NewDefaultLimiter()
+				defer lim.Stop()
+
+				So(func() {
+					lim.Do(DEFAULT_CONTEXT(), func(context.Context) error { panic("boom") })
+				}, ShouldPanic)
+
+				err := lim.Do(Context(time.Millisecond*100), func(context.Context) error { return nil })
+				So(err, ShouldBeNil)
+			})
+
+			Convey("does not run fn once the limiter is stopped", func() {
+				lim := NewDefaultLimiter()
+				lim.Stop()
+
+				ran := false
+				err := lim.Do(DEFAULT_CONTEXT(), func(context.Context) error {
+					ran = true
+					return nil
+				})
+				So(err, ShouldMatchError, multilimiter.LimiterStopped)
+				So(ran, ShouldBeFalse)
+			})
+		})
+
+		Convey("Call returns fn's result", func() {
+			lim := NewDefaultLimiter()
+			defer lim.Stop()
+
+			result, err := multilimiter.Call(DEFAULT_CONTEXT(), lim, func(context.Context) (int, error) {
+				return 42, nil
+			})
+			So(err, ShouldBeNil)
+			So(result, ShouldEqual, 42)
+
+			lim.Stop()
+			result, err = multilimiter.Call(DEFAULT_CONTEXT(), lim, func(context.Context) (int, error) {
+				return 42, nil
+			})
+			So(err, ShouldMatchError, multilimiter.LimiterStopped)
+			So(result, ShouldEqual, 0)
+		})
+
+		Convey("TryExecute", func() {
+			Convey("runs fn when capacity is available", func() {
+				lim := NewBasicLimiter(DEFAULT_RATE, DEFAULT_CONCURRENCY)
+				defer lim.Stop()
+
+				ran := make(chan struct{})
+				So(lim.TryExecute(DEFAULT_CONTEXT(), func(context.Context) { close(ran) }), ShouldBeTrue)
+				<-ran
+			})
+
+			Convey("returns false when concurrency is unavailable", func() {
+				lim := NewBasicLimiter(DEFAULT_RATE, DEFAULT_CONCURRENCY)
+				defer lim.Stop()
+
+				release := make(chan struct{})
+				So(lim.TryExecute(DEFAULT_CONTEXT(), func(context.Context) { <-release }), ShouldBeTrue)
+				So(lim.TryExecute(DEFAULT_CONTEXT(), EmptyExecuteFunc), ShouldBeFalse)
+				close(release)
+			})
+
+			Convey("returns the slot when rate is unavailable", func() {
+				concLim := multilimiter.NewConcLimiter(1)
+				rateLim := multilimiter.NewRateLimiter(1.0, &multilimiter.InitialTokensOption{Tokens: 0})
+				lim := multilimiter.NewLimiter(
+					&multilimiter.ConcLimitOption{Limiter: concLim},
+					&multilimiter.RateLimitOption{Limiter: rateLim},
+				)
+				defer lim.Stop()
+
+				So(lim.TryExecute(DEFAULT_CONTEXT(), EmptyExecuteFunc), ShouldBeFalse)
+				_, ok := concLim.TryAcquire()
+				So(ok, ShouldBeTrue)
+			})
+
+			Convey("returns false once stopped", func() {
+				lim := NewBasicLimiter(DEFAULT_RATE, DEFAULT_CONCURRENCY)
+				lim.Stop()
+				So(lim.TryExecute(DEFAULT_CONTEXT(), EmptyExecuteFunc), ShouldBeFalse)
+			})
+		})
+
+		Convey("reports its configured concurrency and rate", func() {
+			lim := NewBasicLimiter(DEFAULT_RATE, 3)
+			defer lim.Stop()
+			So(lim.Concurrency(), ShouldEqual, 3)
+			So(lim.Rate(), ShouldEqual, DEFAULT_RATE)
+		})
+
+		Convey("ParentOption", func() {
+			global := NewBasicLimiter(0, 2)
+			defer global.Stop()
+			newTenantOf := func(parent *multilimiter.BasicLimiter, conc int) *multilimiter.BasicLimiter {
+				return multilimiter.NewLimiter(
+					&multilimiter.ConcLimitOption{Limiter: multilimiter.NewConcLimiter(conc)},
+					&multilimiter.RateLimitOption{Limiter: multilimiter.NewRateLimiter(0)},
+					&multilimiter.ParentOption{Limiter: parent},
+				)
+			}
+			newTenant := func(conc int) *multilimiter.BasicLimiter {
+				return newTenantOf(global, conc)
+			}
+
+			Convey("caps every tenant by the parent's concurrency", func() {
+				a, b := newTenant(2), newTenant(2)
+				defer a.Stop()
+				defer b.Stop()
+
+				release := make(chan struct{})
+				defer close(release)
+				So(a.TryExecute(DEFAULT_CONTEXT(), func(context.Context) { <-release }), ShouldBeTrue)
+				So(b.TryExecute(DEFAULT_CONTEXT(), func(context.Context) { <-release }), ShouldBeTrue)
+
+				// both tenants have room but the parent does not
+				So(a.TryExecute(DEFAULT_CONTEXT(), EmptyExecuteFunc), ShouldBeFalse)
+				err := b.Execute(Context(time.Millisecond*20), EmptyExecuteFunc)
+				So(err, ShouldMatchError, multilimiter.DeadlineExceeded)
+			})
+
+			Convey("caps a tenant by its own concurrency", func() {
+				a := newTenant(1)
+				defer a.Stop()
+
+				release := make(chan struct{})
+				defer close(release)
+				So(a.TryExecute(DEFAULT_CONTEXT(), func(context.Context) { <-release }), ShouldBeTrue)
+				So(a.TryExecute(DEFAULT_CONTEXT(), EmptyExecuteFunc), ShouldBeFalse)
+				So(global.TryExecute(DEFAULT_CONTEXT(), func(context.Context) { <-release }), ShouldBeTrue)
+			})
+
+			Convey("releases the tenant's slot and tokens when the parent cannot be acquired", func() {
+				concLim := multilimiter.NewConcLimiter(1)
+				rateLim := multilimiter.NewRateLimiter(1.0, &multilimiter.InitialTokensOption{Tokens: 1})
+				a := multilimiter.NewLimiter(
+					&multilimiter.ConcLimitOption{Limiter: concLim},
+					&multilimiter.RateLimitOption{Limiter: rateLim},
+					&multilimiter.ParentOption{Limiter: global},
+				)
+				defer a.Stop()
+
+				global.Stop()
+				So(a.Execute(DEFAULT_CONTEXT(), EmptyExecuteFunc), ShouldMatchError, multilimiter.LimiterStopped)
+				So(a.TryExecute(DEFAULT_CONTEXT(), EmptyExecuteFunc), ShouldBeFalse)
+
+				So(rateLim.Available(), ShouldEqual, 1)
+				_, ok := concLim.TryAcquire()
+				So(ok, ShouldBeTrue)
+			})
+
+			Convey("gives back the parent's slot and tokens when the tenant cannot be acquired", func() {
+				parentRate := multilimiter.NewRateLimiter(1.0, &multilimiter.InitialTokensOption{Tokens: 1})
+				parent := multilimiter.NewLimiter(
+					&multilimiter.ConcLimitOption{Limiter: multilimiter.NewConcLimiter(1)},
+					&multilimiter.RateLimitOption{Limiter: parentRate},
+				)
+				defer parent.Stop()
+				concLim := multilimiter.NewConcLimiter(1)
+				a := multilimiter.NewLimiter(
+					&multilimiter.ConcLimitOption{Limiter: concLim},
+					&multilimiter.RateLimitOption{Limiter: multilimiter.NewRateLimiter(0)},
+					&multilimiter.ParentOption{Limiter: parent},
+				)
+				defer a.Stop()
+
+				// saturate the tenant without touching the parent
+				release := make(chan struct{})
+				defer close(release)
+				concLim.TryAcquire()
+
+				So(a.Execute(Context(time.Millisecond*20), EmptyExecuteFunc), ShouldMatchError, multilimiter.DeadlineExceeded)
+				So(a.TryExecute(DEFAULT_CONTEXT(), EmptyExecuteFunc), ShouldBeFalse)
+
+				So(parentRate.Available(), ShouldEqual, 1)
+				So(parent.TryExecute(DEFAULT_CONTEXT(), func(context.Context) { <-release }), ShouldBeTrue)
+			})
+
+			Convey("gives back the parent's token when the tenant has none to spare", func() {
+				parentRate := multilimiter.NewRateLimiter(1.0, &multilimiter.BurstOption{Capacity: 1})
+				parent := multilimiter.NewLimiter(
+					&multilimiter.ConcLimitOption{Limiter: multilimiter.NewConcLimiter(1)},
+					&multilimiter.RateLimitOption{Limiter: parentRate},
+				)
+				defer parent.Stop()
+				a := multilimiter.NewLimiter(
+					&multilimiter.ConcLimitOption{Limiter: multilimiter.NewConcLimiter(1)},
+					&multilimiter.RateLimitOption{Limiter: multilimiter.NewRateLimiter(1.0, &multilimiter.InitialTokensOption{Tokens: 0})},
+					&multilimiter.ParentOption{Limiter: parent},
+				)
+				defer a.Stop()
+
+				So(a.TryExecute(DEFAULT_CONTEXT(), EmptyExecuteFunc), ShouldBeFalse)
+				So(parentRate.Available(), ShouldEqual, 1)
+			})
+
+			Convey("acquires the parent before the tenant", func() {
+				parent := NewBasicLimiter(0, 1)
+				defer parent.Stop()
+				concLim := multilimiter.NewConcLimiter(1)
+				a := multilimiter.NewLimiter(
+					&multilimiter.ConcLimitOption{Limiter: concLim},
+					&multilimiter.RateLimitOption{Limiter: multilimiter.NewRateLimiter(0)},
+					&multilimiter.ParentOption{Limiter: parent},
+				)
+				defer a.Stop()
+
+				release := make(chan struct{})
+				So(parent.TryExecute(DEFAULT_CONTEXT(), func(context.Context) { <-release }), ShouldBeTrue)
+
+				// the tenant's slot stays free while its caller waits on the parent
+				errs := make(chan error, 1)
+				go func() { errs <- a.Execute(DEFAULT_CONTEXT(), EmptyExecuteFunc) }()
+				time.Sleep(time.Millisecond * 10)
+				slot, ok := concLim.TryAcquire()
+				So(ok, ShouldBeTrue)
+				slot.Release()
+
+				close(release)
+				So(<-errs, ShouldBeNil)
+			})
+
+			Convey("tells the parent's observer and outcome listener about the tenant's functions", func() {
+				observer := &RecordingObserver{}
+				rateLim := NewAdaptiveRateLimiter(100, 1, 100, &multilimiter.AdaptiveRatePolicy{Decay: 0.5})
+				parent := multilimiter.NewLimiter(
+					&multilimiter.ConcLimitOption{Limiter: multilimiter.NewConcLimiter(2)},
+					&multilimiter.RateLimitOption{Limiter: rateLim},
+					&multilimiter.ObserverOption{Observer: observer},
+				)
+				defer parent.Stop()
+				a := newTenantOf(parent, 2)
+				defer a.Stop()
+
+				So(a.Do(DEFAULT_CONTEXT(), func(ctx context.Context) error {
+					multilimiter.ReportOutcome(ctx, multilimiter.OutcomeThrottled)
+					return nil
+				}), ShouldBeNil)
+				So(a.TryExecute(DEFAULT_CONTEXT(), EmptyExecuteFunc), ShouldBeTrue)
+				a.Wait()
+
+				So(observer.Events(), ShouldResemble, []string{
+					"acquire_start", "acquire", "task_start", "task_end",
+					"acquire_start", "acquire", "task_start", "task_end",
+				})
+				So(rateLim.Rate(), ShouldEqual, 50)
+			})
+
+			Convey("releases the parent's slot when the function finishes", func() {
+				a := newTenant(2)
+				defer a.Stop()
+
+				for i := 0; i < 10; i++ {
+					So(a.Do(DEFAULT_CONTEXT(), func(context.Context) error { return nil }), ShouldBeNil)
+				}
+				So(WaitsWithin(func() { global.Wait() }, time.Second), ShouldBeTrue)
+			})
+		})
+
+		Convey("wait queue", func() {
+			release := make(chan struct{})
+			defer close(release)
+			newQueuedLimiter := func(opts ...multilimiter.Option) *multilimiter.BasicLimiter {
+				opts = append(opts,
+					&multilimiter.ConcLimitOption{Limiter: multilimiter.NewConcLimiter(1)},
+					&multilimiter.RateLimitOption{Limiter: multilimiter.NewRateLimiter(0)},
+				)
+				lim := multilimiter.NewLimiter(opts...)
+				lim.Execute(DEFAULT_CONTEXT(), func(context.Context) { <-release })
+				return lim
+			}
+			// queues a caller and returns the error it gets
+			queue := func(lim *multilimiter.BasicLimiter) <-chan error {
+				errs := make(chan error, 1)
+				go func() { errs <- lim.Execute(Context(time.Second), EmptyExecuteFunc) }()
+				time.Sleep(time.Millisecond * 10)
+				return errs
+			}
+
+			Convey("MaxQueueLengthOption rejects callers once the queue is full", func() {
+				lim := newQueuedLimiter(&multilimiter.MaxQueueLengthOption{Length: 2})
+				defer lim.Stop()
+				queue(lim)
+				queue(lim)
+
+				started := time.Now()
+				So(lim.Execute(DEFAULT_CONTEXT(), EmptyExecuteFunc), ShouldMatchError, multilimiter.ErrQueueFull)
+				So(lim.Do(DEFAULT_CONTEXT(), func(context.Context) error { return nil }), ShouldMatchError, multilimiter.ErrQueueFull)
+				So(time.Since(started), ShouldBeLessThan, time.Millisecond*5)
+			})
+
+			Convey("QueueDropOldest sheds the caller that has waited longest", func() {
+				lim := newQueuedLimiter(&multilimiter.MaxQueueLengthOption{Length: 1, Policy: multilimiter.QueueDropOldest})
+				defer lim.Stop()
+				oldest := queue(lim)
+				newest := queue(lim)
+
+				So(<-oldest, ShouldMatchError, multilimiter.ErrQueueFull)
+				So(newest, ShouldHaveLength, 0)
+			})
+
+			Convey("QueueCoDel", func() {
+				codel := &multilimiter.MaxQueueLengthOption{
+					Policy:   multilimiter.QueueCoDel,
+					Target:   time.Millisecond * 5,
+					Interval: time.Millisecond * 30,
+				}
+				// runs callers that all queue at once and counts how many were served and shed
+				run := func(lim *multilimiter.BasicLimiter, callers int, hold time.Duration) (served, shed int) {
+					errs := make(chan error, callers)
+					for i := 0; i < callers; i++ {
+						go func() {
+							errs <- lim.Do(Context(time.Second), func(context.Context) error {
+								time.Sleep(hold)
+								return nil
+							})
+						}()
+					}
+					for i := 0; i < callers; i++ {
+						switch err := <-errs; {
+						case err == nil:
+							served++
+						case errors.Is(err, multilimiter.ErrQueueFull):
+							shed++
+						}
+					}
+					return served, shed
+				}
+				newCoDelLimiter := func() *multilimiter.BasicLimiter {
+					return multilimiter.NewLimiter(codel,
+						&multilimiter.ConcLimitOption{Limiter: multilimiter.NewConcLimiter(1)},
+						&multilimiter.RateLimitOption{Limiter: multilimiter.NewRateLimiter(0)},
+					)
+				}
+
+				Convey("sheds the oldest callers once waits stay above Target for an Interval", func() {
+					lim := newCoDelLimiter()
+					defer lim.Stop()
+
+					// every wait is above Target but the first few are admitted before an Interval has passed
+					served, shed := run(lim, 10, time.Millisecond*10)
+					So(served, ShouldBeGreaterThanOrEqualTo, 3)
+					So(shed, ShouldBeGreaterThan, 0)
+					So(served+shed, ShouldEqual, 10)
+				})
+
+				Convey("leaves the queue alone while waits stay below Target", func() {
+					lim := newCoDelLimiter()
+					defer lim.Stop()
+
+					served, _ := run(lim, 10, 0)
+					So(served, ShouldEqual, 10)
+				})
+
+				Convey("only sheds as callers are admitted", func() {
+					lim := newQueuedLimiter(codel)
+					defer lim.Stop()
+
+					err := lim.Execute(Context(time.Millisecond*50), EmptyExecuteFunc)
+					So(err, ShouldMatchError, multilimiter.DeadlineExceeded)
+				})
+			})
+
+			Convey("QueueTimeoutOption limits how long callers wait", func() {
+				lim := newQueuedLimiter(&multilimiter.QueueTimeoutOption{Timeout: time.Millisecond * 20})
+				defer lim.Stop()
+
+				started := time.Now()
+				err := lim.Execute(Context(time.Second), EmptyExecuteFunc)
+				So(err, ShouldMatchError, multilimiter.DeadlineExceeded)
+				So(time.Since(started), ShouldBeLessThan, time.Millisecond*100)
+			})
+
+			Convey("callers that are served leave the queue", func() {
+				lim := multilimiter.NewLimiter(
+					&multilimiter.MaxQueueLengthOption{Length: 1},
+					&multilimiter.RateLimitOption{Limiter: multilimiter.NewRateLimiter(0)},
+				)
+				defer lim.Stop()
+
+				for i := 0; i < 10; i++ {
+					So(lim.Do(DEFAULT_CONTEXT(), func(context.Context) error { return nil }), ShouldBeNil)
+				}
+			})
+		})
+
+		Convey("panics in Execute", func() {
+			PanicFunc := func(context.Context) { panic("boom") }
+
+			Convey("are logged when using PanicLog", func() {
+				var buf bytes.Buffer
+				lim := multilimiter.NewLimiter(
+					&multilimiter.PanicOption{Mode: multilimiter.PanicLog},
+					&multilimiter.LogOption{Logger: log.New(&buf, "", 0)},
+				)
+				defer lim.Stop()
+
+				So(lim.Execute(DEFAULT_CONTEXT(), PanicFunc), ShouldBeNil)
+				So(lim.Wait(), ShouldBeNil)
+				So(buf.String(), ShouldStartWith, "Panic found in BasicLimiter: boom")
+
+				// the limiter keeps working after the panic
+				So(lim.Execute(DEFAULT_CONTEXT(), EmptyExecuteFunc), ShouldBeNil)
+				So(lim.Wait(), ShouldBeNil)
+			})
+
+			Convey("are passed to the handler when using PanicHandle", func() {
+				var recovered interface{}
+				var stack []byte
+				handler := func(ctx context.Context, r interface{}, s []byte) {
+					recovered, stack = r, s
+				}
+				lim := multilimiter.NewLimiter(&multilimiter.PanicOption{Mode: multilimiter.PanicHandle, Handler: handler})
+				defer lim.Stop()
+
+				So(lim.Execute(DEFAULT_CONTEXT(), PanicFunc), ShouldBeNil)
+				So(lim.Wait(), ShouldBeNil)
+				So(recovered, ShouldEqual, "boom")
+				So(len(stack), ShouldBeGreaterThan, 0)
+			})
+
+			Convey("release the slot even if the handler never returns", func() {
+				// Goexit abandons the handler the same way a panic would without crashing the test
+				handler := func(context.Context, interface{}, []byte) { runtime.Goexit() }
+				lim := multilimiter.NewLimiter(&multilimiter.PanicOption{Mode: multilimiter.PanicHandle, Handler: handler})
+				defer lim.Stop()
+
+				So(lim.Execute(DEFAULT_CONTEXT(), PanicFunc), ShouldBeNil)
+				So(WaitsWithin(func() { lim.Wait() }, time.Second), ShouldBeTrue)
+				_, err := lim.Shutdown(DEFAULT_CONTEXT())
+				So(err, ShouldBeNil)
+			})
+
+			Convey("are returned by Wait when using PanicCollect", func() {
+				lim := multilimiter.NewLimiter(
+					&multilimiter.PanicOption{Mode: multilimiter.PanicCollect},
+					&multilimiter.ConcLimitOption{Limiter: multilimiter.NewConcLimiter(2)},
+				)
+				defer lim.Stop()
+
+				So(lim.Execute(DEFAULT_CONTEXT(), PanicFunc), ShouldBeNil)
+				So(lim.Execute(DEFAULT_CONTEXT(), EmptyExecuteFunc), ShouldBeNil)
+				So(lim.Execute(DEFAULT_CONTEXT(), PanicFunc), ShouldBeNil)
+
+				err := lim.Wait()
+				var panicErr *multilimiter.PanicError
+				So(errors.As(err, &panicErr), ShouldBeTrue)
+				So(panicErr.Value, ShouldEqual, "boom")
+				So(strings.Count(err.Error(), "boom"), ShouldEqual, 2)
+
+				// collected panics are cleared once returned
+				So(lim.Wait(), ShouldBeNil)
+			})
 		})
 
 		Convey("timeouts occur when", func() {
@@ -59,7 +712,7 @@ func TestLimiterSpec(t *testing.T) {
 				lim := multilimiter.NewLimiter(rateOpt, concOpt)
 
 				err := lim.Execute(ctx, EmptyExecuteFunc)
-				So(err, ShouldEqual, multilimiter.DeadlineExceeded)
+				So(err, ShouldMatchError, multilimiter.DeadlineExceeded)
 			})
 
 			Convey("concurrency limiter cannot acquire a slot quickly enough", func() {
@@ -83,10 +736,85 @@ func TestLimiterSpec(t *testing.T) {
 				<-done
 
 				So(err1, ShouldBeNil)
-				So(err2, ShouldEqual, multilimiter.DeadlineExceeded)
+				So(err2, ShouldMatchError, multilimiter.DeadlineExceeded)
 			})
 		})
 
+		Convey("concurrency slots are conserved when", func() {
+			concurrency, executions := 5, 2000
+
+			// a rate limiter that never has tokens available in time
+			NewSlowLimiter := func(concLim multilimiter.ConcLimiter) multilimiter.Limiter {
+				typedLim := multilimiter.NewRateLimiter(1).(multilimiter.TestableRateLimiter)
+				rateOpt := &multilimiter.RateLimitOption{Limiter: &SlowRateLimiter{typedLim, 1000}}
+				return multilimiter.NewLimiter(rateOpt, &multilimiter.ConcLimitOption{Limiter: concLim})
+			}
+
+			AllSlotsAreAvailable := func(lim multilimiter.Limiter, concLim multilimiter.ConcLimiter) {
+				So(WaitsWithin(func() { lim.Wait() }, time.Second), ShouldBeTrue)
+
+				for i := 0; i < concLim.Concurrency(); i++ {
+					_, err := concLim.Acquire(Context(time.Millisecond * 100))
+					So(err, ShouldBeNil)
+				}
+			}
+
+			Convey("thousands of calls time out waiting on the rate limiter", func() {
+				concLim := multilimiter.NewConcLimiter(concurrency)
+				lim := NewSlowLimiter(concLim)
+
+				for i := 0; i < executions; i++ {
+					err := lim.Execute(Context(time.Microsecond*50), EmptyExecuteFunc)
+					So(err, ShouldMatchError, multilimiter.DeadlineExceeded)
+				}
+
+				AllSlotsAreAvailable(lim, concLim)
+			})
+
+			Convey("thousands of concurrent calls time out waiting on the rate limiter", func() {
+				concLim := multilimiter.NewConcLimiter(concurrency)
+				lim := NewSlowLimiter(concLim)
+
+				var wg sync.WaitGroup
+				var failures int32
+				for i := 0; i < executions; i++ {
+					wg.Add(1)
+					go func() {
+						defer wg.Done()
+						if err := lim.Execute(Context(time.Millisecond), EmptyExecuteFunc); err != nil {
+							atomic.AddInt32(&failures, 1)
+						}
+					}()
+				}
+				wg.Wait()
+
+				So(failures, ShouldEqual, executions)
+				AllSlotsAreAvailable(lim, concLim)
+			})
+		})
+
+		Convey("rate tokens and the slot are returned when waiting on rate is canceled", func() {
+			rateLim := multilimiter.NewRateLimiter(1.0)
+			concLim := multilimiter.NewConcLimiter(1)
+			lim := multilimiter.NewLimiter(
+				&multilimiter.RateLimitOption{Limiter: rateLim},
+				&multilimiter.ConcLimitOption{Limiter: concLim},
+			)
+			defer lim.Stop()
+
+			rateLim.Reserve(2)
+			ctx, cancel := ContextWithCancel(0)
+			go func() {
+				time.Sleep(time.Millisecond * 20)
+				cancel()
+			}()
+
+			err := lim.Execute(ctx, EmptyExecuteFunc)
+			So(err, ShouldMatchError, multilimiter.DeadlineExceeded)
+			So(rateLim.Available(), ShouldEqual, 0)
+			So(WaitsWithin(func() { lim.Wait() }, time.Second), ShouldBeTrue)
+		})
+
 		Convey("concurrency", func() {
 
 			// without a sleep we can't guarantee we hit the max concurrency because
@@ -100,6 +828,21 @@ func TestLimiterSpec(t *testing.T) {
 				So(tracker.Max(), ShouldEqual, concurrency)
 			}
 
+			Convey("ExecuteN counts weight against the concurrency", func() {
+				lim := NewBasicLimiter(1000, 4)
+				tracker := &multilimiter.ConcurrencyTracker{}
+				for i := 0; i < 10; i++ {
+					err := lim.ExecuteN(DEFAULT_CONTEXT(), 1, 2, func(context.Context) {
+						tracker.Add()
+						time.Sleep(DELAY / 3)
+						tracker.Subtract()
+					})
+					So(err, ShouldBeNil)
+				}
+				lim.Wait()
+				So(tracker.Max(), ShouldEqual, 2)
+			})
+
 			Convey("only runs one function at a time with 1 concurrency", func() {
 				concurrency, executions := 1, 11
 				RunConcurrencyTest(DEFAULT_RATE, concurrency, executions)
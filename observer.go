@@ -0,0 +1,124 @@
+package multilimiter
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// Receives notifications about what a BasicLimiter is doing, e.g. to record metrics
+// Callbacks are made synchronously from the calling go routines so they must be fast and thread-safe
+// Embed NoopObserver to only implement some of them
+type Observer interface {
+	// A caller started waiting for concurrency and rate
+	OnAcquireStart()
+	// A caller acquired concurrency and rate after waiting for waited
+	OnAcquire(waited time.Duration)
+	// A caller was turned away; err is nil for RejectUnavailable
+	OnReject(reason RejectReason, err error)
+	// A function started running
+	OnTaskStart()
+	// A function finished after running for duration
+	OnTaskEnd(duration time.Duration, panicked bool)
+	// The limiter was stopped
+	OnStop()
+}
+
+// Why a caller was turned away by a BasicLimiter
+type RejectReason string
+
+const (
+	// The limiter has been stopped
+	RejectStopped RejectReason = "stopped"
+	// The caller's context or the QueueTimeoutOption ran out while waiting
+	RejectTimeout RejectReason = "timeout"
+	// The caller's context was canceled while waiting
+	RejectCanceled RejectReason = "canceled"
+	// The caller was shed by the MaxQueueLengthOption
+	RejectQueueFull RejectReason = "queue_full"
+	// The caller asked for more weight than the concurrency limiter can ever provide
+	RejectWeight RejectReason = "weight_exceeds_limit"
+	// TryExecute() found no concurrency or rate available
+	RejectUnavailable RejectReason = "unavailable"
+)
+
+// Classifies an error returned by a Limiter while acquiring concurrency and rate
+func RejectReasonOf(err error) RejectReason {
+	switch {
+	case errors.Is(err, LimiterStopped):
+		return RejectStopped
+	case errors.Is(err, ErrQueueFull):
+		return RejectQueueFull
+	case errors.Is(err, WeightExceedsLimit):
+		return RejectWeight
+	case errors.Is(err, context.Canceled):
+		return RejectCanceled
+	default:
+		return RejectTimeout
+	}
+}
+
+// An Observer that ignores everything
+type NoopObserver struct{}
+
+var _ Observer = NoopObserver{}
+
+func (me NoopObserver) OnAcquireStart()                                 {}
+func (me NoopObserver) OnAcquire(waited time.Duration)                  {}
+func (me NoopObserver) OnReject(reason RejectReason, err error)         {}
+func (me NoopObserver) OnTaskStart()                                    {}
+func (me NoopObserver) OnTaskEnd(duration time.Duration, panicked bool) {}
+func (me NoopObserver) OnStop()                                         {}
+
+// Passes every notification on to each of its observers
+type multiObserver []Observer
+
+var _ Observer = multiObserver(nil)
+
+// Combines observers into one
+func newObserver(observers []Observer) Observer {
+	switch len(observers) {
+	case 0:
+		return NoopObserver{}
+	case 1:
+		return observers[0]
+	default:
+		return multiObserver(observers)
+	}
+}
+
+func (me multiObserver) OnAcquireStart() {
+	for _, o := range me {
+		o.OnAcquireStart()
+	}
+}
+
+func (me multiObserver) OnAcquire(waited time.Duration) {
+	for _, o := range me {
+		o.OnAcquire(waited)
+	}
+}
+
+func (me multiObserver) OnReject(reason RejectReason, err error) {
+	for _, o := range me {
+		o.OnReject(reason, err)
+	}
+}
+
+func (me multiObserver) OnTaskStart() {
+	for _, o := range me {
+		o.OnTaskStart()
+	}
+}
+
+func (me multiObserver) OnTaskEnd(duration time.Duration, panicked bool) {
+	for _, o := range me {
+		o.OnTaskEnd(duration, panicked)
+	}
+}
+
+func (me multiObserver) OnStop() {
+	for _, o := range me {
+		o.OnStop()
+	}
+}
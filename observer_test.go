@@ -0,0 +1,229 @@
+package multilimiter_test
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jrboelens/multilimiter"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestObserverSpec(t *testing.T) {
+	Convey("Observer", t, func() {
+		rec := &RecordingObserver{}
+		newObservedLimiter := func(concurrency int, opts ...multilimiter.Option) *multilimiter.BasicLimiter {
+			opts = append(opts,
+				&multilimiter.ConcLimitOption{Limiter: multilimiter.NewConcLimiter(concurrency)},
+				&multilimiter.RateLimitOption{Limiter: multilimiter.NewRateLimiter(0)},
+				&multilimiter.ObserverOption{Observer: rec},
+			)
+			return multilimiter.NewLimiter(opts...)
+		}
+
+		Convey("is told about each acquisition and task", func() {
+			lim := newObservedLimiter(1)
+			defer lim.Stop()
+
+			So(lim.Execute(Context(time.Second), func(context.Context) { time.Sleep(time.Millisecond * 10) }), ShouldBeNil)
+			lim.Wait()
+
+			So(rec.Events(), ShouldResemble, []string{"acquire_start", "acquire", "task_start", "task_end"})
+			So(rec.TaskDurations[0], ShouldBeGreaterThanOrEqualTo, time.Millisecond*10)
+			So(rec.Panicked, ShouldEqual, 0)
+		})
+
+		Convey("is told about a TryExecute that finds capacity", func() {
+			lim := newObservedLimiter(1)
+			defer lim.Stop()
+
+			So(lim.TryExecute(Context(time.Second), func(context.Context) {}), ShouldBeTrue)
+			lim.Wait()
+
+			So(rec.Events(), ShouldResemble, []string{"acquire_start", "acquire", "task_start", "task_end"})
+			So(rec.Waited, ShouldResemble, []time.Duration{0})
+		})
+
+		Convey("reports how long callers waited", func() {
+			lim := newObservedLimiter(1)
+			defer lim.Stop()
+
+			lim.Execute(Context(time.Second), func(context.Context) { time.Sleep(time.Millisecond * 20) })
+			So(lim.Do(Context(time.Second), func(context.Context) error { return nil }), ShouldBeNil)
+
+			So(rec.Waited, ShouldHaveLength, 2)
+			So(rec.Waited[1], ShouldBeGreaterThanOrEqualTo, time.Millisecond*10)
+		})
+
+		Convey("is told when a task panics", func() {
+			lim := newObservedLimiter(1, &multilimiter.PanicOption{Mode: multilimiter.PanicHandle, Handler: func(context.Context, interface{}, []byte) {}})
+			defer lim.Stop()
+
+			lim.Execute(Context(time.Second), func(context.Context) { panic("boom") })
+			lim.Wait()
+			So(rec.Panicked, ShouldEqual, 1)
+		})
+
+		Convey("is told why callers were rejected", func() {
+			release := make(chan struct{})
+			defer close(release)
+
+			Convey("when the caller's context expires", func() {
+				lim := newObservedLimiter(1)
+				defer lim.Stop()
+				lim.Execute(Context(time.Second), func(context.Context) { <-release })
+
+				err := lim.Execute(Context(time.Millisecond*10), func(context.Context) {})
+				So(err, ShouldMatchError, multilimiter.DeadlineExceeded)
+				So(rec.Rejects(), ShouldResemble, []multilimiter.RejectReason{multilimiter.RejectTimeout})
+			})
+
+			Convey("when the caller's context is canceled", func() {
+				lim := newObservedLimiter(1)
+				defer lim.Stop()
+				lim.Execute(Context(time.Second), func(context.Context) { <-release })
+
+				ctx, cancel := context.WithCancel(context.Background())
+				time.AfterFunc(time.Millisecond*10, cancel)
+				err := lim.Execute(ctx, func(context.Context) {})
+				So(err, ShouldMatchError, context.Canceled)
+				So(rec.Rejects(), ShouldResemble, []multilimiter.RejectReason{multilimiter.RejectCanceled})
+			})
+
+			Convey("when the wait queue is full", func() {
+				lim := newObservedLimiter(1, &multilimiter.MaxQueueLengthOption{Length: 1})
+				defer lim.Stop()
+				lim.Execute(Context(time.Second), func(context.Context) { <-release })
+				go lim.Execute(Context(time.Second), func(context.Context) {})
+				time.Sleep(time.Millisecond * 10)
+
+				lim.Execute(Context(time.Second), func(context.Context) {})
+				So(rec.Rejects(), ShouldResemble, []multilimiter.RejectReason{multilimiter.RejectQueueFull})
+			})
+
+			Convey("when the weight can never be satisfied", func() {
+				lim := newObservedLimiter(1)
+				defer lim.Stop()
+
+				lim.ExecuteN(Context(time.Second), 1, 2, func(context.Context) {})
+				So(rec.Rejects(), ShouldResemble, []multilimiter.RejectReason{multilimiter.RejectWeight})
+			})
+
+			Convey("when TryExecute finds no capacity", func() {
+				lim := newObservedLimiter(1)
+				defer lim.Stop()
+				lim.Execute(Context(time.Second), func(context.Context) { <-release })
+
+				So(lim.TryExecute(Context(time.Second), func(context.Context) {}), ShouldBeFalse)
+				So(rec.Rejects(), ShouldResemble, []multilimiter.RejectReason{multilimiter.RejectUnavailable})
+				So(rec.Events()[2:], ShouldResemble, []string{"acquire_start", "reject"})
+			})
+
+			Convey("once the limiter is stopped", func() {
+				lim := newObservedLimiter(1)
+				lim.Stop()
+
+				lim.Execute(Context(time.Second), func(context.Context) {})
+				lim.TryExecute(Context(time.Second), func(context.Context) {})
+				So(rec.Rejects(), ShouldResemble, []multilimiter.RejectReason{multilimiter.RejectStopped, multilimiter.RejectStopped})
+			})
+		})
+
+		Convey("is told once when the limiter stops", func() {
+			lim := newObservedLimiter(1)
+			lim.Stop()
+			lim.Stop()
+			So(rec.Events(), ShouldResemble, []string{"stop"})
+		})
+
+		Convey("can be registered more than once", func() {
+			other := &RecordingObserver{}
+			lim := newObservedLimiter(1, &multilimiter.ObserverOption{Observer: other})
+			defer lim.Stop()
+
+			lim.Execute(Context(time.Second), func(context.Context) {})
+			lim.Wait()
+			So(rec.Events(), ShouldResemble, other.Events())
+			So(other.Events(), ShouldHaveLength, 4)
+		})
+
+		Convey("ConcurrencyTracker counts tasks as an observer", func() {
+			tracker := &multilimiter.ConcurrencyTracker{}
+			lim := newObservedLimiter(3, &multilimiter.ObserverOption{Observer: tracker})
+			defer lim.Stop()
+
+			for i := 0; i < 9; i++ {
+				lim.Execute(Context(time.Second), func(context.Context) { time.Sleep(time.Millisecond * 10) })
+			}
+			lim.Wait()
+			So(tracker.Total(), ShouldEqual, 9)
+			So(tracker.Max(), ShouldEqual, 3)
+			So(tracker.Current(), ShouldEqual, 0)
+		})
+	})
+}
+
+// Records every notification it receives
+type RecordingObserver struct {
+	mu            sync.Mutex
+	events        []string
+	rejects       []multilimiter.RejectReason
+	Waited        []time.Duration
+	TaskDurations []time.Duration
+	Panicked      int
+}
+
+func (me *RecordingObserver) record(event string) {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	me.events = append(me.events, event)
+}
+
+func (me *RecordingObserver) Events() []string {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	return append([]string(nil), me.events...)
+}
+
+func (me *RecordingObserver) Rejects() []multilimiter.RejectReason {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	return append([]multilimiter.RejectReason(nil), me.rejects...)
+}
+
+func (me *RecordingObserver) OnAcquireStart() {
+	me.record("acquire_start")
+}
+
+func (me *RecordingObserver) OnAcquire(waited time.Duration) {
+	me.record("acquire")
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	me.Waited = append(me.Waited, waited)
+}
+
+func (me *RecordingObserver) OnReject(reason multilimiter.RejectReason, err error) {
+	me.record("reject")
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	me.rejects = append(me.rejects, reason)
+}
+
+func (me *RecordingObserver) OnTaskStart() {
+	me.record("task_start")
+}
+
+func (me *RecordingObserver) OnTaskEnd(duration time.Duration, panicked bool) {
+	me.record("task_end")
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	me.TaskDurations = append(me.TaskDurations, duration)
+	if panicked {
+		me.Panicked++
+	}
+}
+
+func (me *RecordingObserver) OnStop() {
+	me.record("stop")
+}
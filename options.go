@@ -1,7 +1,15 @@
 package multilimiter
 
+import (
+	"context"
+	"log"
+	"os"
+	"time"
+)
+
 const DEFAULT_RATE = 1.0
 const DEFAULT_CONCURRENCY = 1
+const DEFAULT_BURST = 2
 
 // Base interface for all options
 type Option interface {
@@ -10,8 +18,20 @@ type Option interface {
 
 // Contains all possible options
 type options struct {
-	rateLimit *RateLimitOption
+	rateLimit []RateLimiter
 	concLimit *ConcLimitOption
+	panic     *PanicOption
+	log       *LogOption
+	taskCtx   *TaskContextOption
+	outcome   *OutcomeOption
+	parent    *ParentOption
+	// nil unless queueing is limited
+	queueLength  *MaxQueueLengthOption
+	queueTimeout *QueueTimeoutOption
+	observers    []Observer
+	// set when the limiters were created here rather than passed in
+	ownsRate bool
+	ownsConc bool
 }
 
 // Creates an instance of options out of a slice of Options
@@ -27,21 +47,39 @@ func CreateOptions(opts ...Option) *options {
 }
 
 func setDefaultOpts(allOpts *options) {
-	if allOpts.rateLimit == nil {
-		allOpts.rateLimit = &RateLimitOption{NewRateLimiter(DEFAULT_RATE)}
+	if len(allOpts.rateLimit) == 0 {
+		allOpts.rateLimit = []RateLimiter{NewRateLimiter(DEFAULT_RATE)}
+		allOpts.ownsRate = true
 	}
 	if allOpts.concLimit == nil {
 		allOpts.concLimit = &ConcLimitOption{NewConcLimiter(DEFAULT_CONCURRENCY)}
+		allOpts.ownsConc = true
+	}
+	if allOpts.panic == nil {
+		allOpts.panic = &PanicOption{Mode: PanicCrash}
+	}
+	if allOpts.outcome == nil {
+		allOpts.outcome = &OutcomeOption{}
+	}
+	if allOpts.parent == nil {
+		allOpts.parent = &ParentOption{}
+	}
+	if allOpts.taskCtx == nil {
+		allOpts.taskCtx = &TaskContextOption{}
+	}
+	if allOpts.log == nil || allOpts.log.Logger == nil {
+		allOpts.log = &LogOption{log.New(os.Stdout, "", log.LstdFlags)}
 	}
 }
 
 // option for controlling rate limiting
+// Several RateLimitOptions can be given, e.g. one per quota window, and all of them must be satisfied
 type RateLimitOption struct {
 	Limiter RateLimiter
 }
 
 func (me *RateLimitOption) apply(allopts *options) {
-	allopts.rateLimit = me
+	allopts.rateLimit = append(allopts.rateLimit, me.Limiter)
 }
 
 // option for controlling concurrency
@@ -52,3 +90,308 @@ type ConcLimitOption struct {
 func (me *ConcLimitOption) apply(allopts *options) {
 	allopts.concLimit = me
 }
+
+// option for nesting a limiter under a parent, e.g. a per-tenant limiter under a global one
+// A function must acquire its parent's concurrency and rate and then the limiter's own
+// If the limiter cannot be acquired the parent's slot and tokens are given back
+// The parent's Observer and OutcomeListener are told about functions run through the limiter
+// Parents may have parents of their own; many limiters may share one parent
+type ParentOption struct {
+	Limiter *BasicLimiter
+}
+
+func (me *ParentOption) apply(allopts *options) {
+	allopts.parent = me
+}
+
+// option for observing what the limiter is doing, e.g. to record metrics
+// Several ObserverOptions can be given and all of them are notified
+type ObserverOption struct {
+	Observer Observer
+}
+
+func (me *ObserverOption) apply(allopts *options) {
+	allopts.observers = append(allopts.observers, me.Observer)
+}
+
+// Determines which callers are shed once the wait queue is full or backed up
+type QueuePolicy int
+
+const (
+	// Reject callers that arrive while the queue is full
+	QueueRejectNew QueuePolicy = iota
+	// Admit callers that arrive while the queue is full by dropping the caller that has waited longest
+	// Under overload fresh callers are served while stale ones, which have likely given up, are shed
+	QueueDropOldest
+	// Reject callers that arrive while the queue is full and shed callers using CoDel (RFC 8289)
+	// Each admitted caller's time in the queue is measured; once those times have stayed above
+	// Target for a whole Interval the oldest callers are shed, increasingly often, until they fall back below it
+	// A queue that admits nobody sheds nobody so pair this with a QueueTimeoutOption or context deadline
+	QueueCoDel
+)
+
+// option for limiting how many callers may wait in Execute(), Do() and Submit() at once
+// Callers count as waiting until they have acquired both concurrency and rate
+// Callers that are shed get ErrQueueFull
+// By default the number of waiting callers is unlimited
+type MaxQueueLengthOption struct {
+	Length int
+	Policy QueuePolicy
+	// The time in the queue that QueueCoDel tolerates as standing delay; defaults to 5ms
+	Target time.Duration
+	// How long waits must stay above Target before QueueCoDel starts shedding; defaults to 100ms
+	Interval time.Duration
+}
+
+func (me *MaxQueueLengthOption) apply(allopts *options) {
+	allopts.queueLength = me
+}
+
+// option for limiting how long callers may wait in Execute(), Do() and Submit()
+// Callers that wait longer get an error matching DeadlineExceeded even if their context allows more time
+// By default callers wait for as long as their context allows
+type QueueTimeoutOption struct {
+	Timeout time.Duration
+}
+
+func (me *QueueTimeoutOption) apply(allopts *options) {
+	allopts.queueTimeout = me
+}
+
+// Determines what happens when a function run by Limiter.Execute() panics
+type PanicMode int
+
+const (
+	// Log the panic and re-panic, crashing the process
+	PanicCrash PanicMode = iota
+	// Log the panic and continue
+	PanicLog
+	// Pass the panic to the PanicOption's Handler
+	PanicHandle
+	// Collect the panic so that Limiter.Wait() returns it
+	PanicCollect
+)
+
+// Receives panics recovered from functions run by Limiter.Execute()
+type PanicHandler func(ctx context.Context, recovered interface{}, stack []byte)
+
+// option for controlling how panics are handled
+// The default mode is PanicCrash
+type PanicOption struct {
+	Mode PanicMode
+	// Only used by PanicHandle; a nil Handler falls back to PanicLog
+	Handler PanicHandler
+}
+
+func (me *PanicOption) apply(allopts *options) {
+	allopts.panic = me
+}
+
+// Used by the limiter to report problems such as panics
+// *log.Logger satisfies this interface
+type Logger interface {
+	Printf(format string, v ...interface{})
+}
+
+// option for controlling where the limiter logs
+// The default logger writes to os.Stdout
+type LogOption struct {
+	Logger Logger
+}
+
+func (me *LogOption) apply(allopts *options) {
+	allopts.log = me
+}
+
+// option for controlling the context passed to executed functions
+// By default functions receive the context passed to Execute() unchanged
+type TaskContextOption struct {
+	// Cancels the function's context once Timeout elapses; 0 means no timeout
+	Timeout time.Duration
+	// Ignores the cancellation and deadline of the caller's context
+	// so that a deadline meant for acquiring slots doesn't also limit the function
+	Detach bool
+	// Cancels the function's context when the limiter is stopped
+	CancelOnStop bool
+}
+
+func (me *TaskContextOption) apply(allopts *options) {
+	allopts.taskCtx = me
+}
+
+// option for deriving outcomes from the errors returned to Do(), Call() and Submit()
+// An outcome reported with ReportOutcome() takes precedence over the classifier
+// By default returned errors do not affect the outcome
+type OutcomeOption struct {
+	Classifier OutcomeClassifier
+}
+
+func (me *OutcomeOption) apply(allopts *options) {
+	allopts.outcome = me
+}
+
+// Base interface for options that configure a BasicRateLimiter's token bucket
+type BucketOption interface {
+	applyBucket(*bucketOptions)
+}
+
+// Contains all possible token bucket options
+type bucketOptions struct {
+	capacity int64
+	initial  *int64
+	quantum  int64
+	fairness Fairness
+}
+
+// Creates an instance of bucketOptions out of a slice of BucketOptions
+func createBucketOptions(opts ...BucketOption) *bucketOptions {
+	allOpts := &bucketOptions{}
+
+	for _, opt := range opts {
+		opt.applyBucket(allOpts)
+	}
+
+	if allOpts.capacity < 1 {
+		allOpts.capacity = DEFAULT_BURST
+	}
+	if allOpts.initial != nil {
+		initial := *allOpts.initial
+		if initial < 0 {
+			initial = 0
+		}
+		if initial > allOpts.capacity {
+			initial = allOpts.capacity
+		}
+		allOpts.initial = &initial
+	}
+	if allOpts.fairness == FairnessDefault {
+		allOpts.fairness = FairnessNone
+	}
+	return allOpts
+}
+
+// option for controlling how many tokens the bucket can hold
+// Larger capacities allow larger bursts; values < 1 use DEFAULT_BURST
+type BurstOption struct {
+	Capacity int64
+}
+
+func (me *BurstOption) applyBucket(allopts *bucketOptions) {
+	allopts.capacity = me.Capacity
+}
+
+// option for controlling how many tokens the bucket starts with
+// The bucket starts full by default
+type InitialTokensOption struct {
+	Tokens int64
+}
+
+func (me *InitialTokensOption) applyBucket(allopts *bucketOptions) {
+	tokens := me.Tokens
+	allopts.initial = &tokens
+}
+
+// option for controlling how many tokens are added to the bucket at a time
+// By default tokens accrue continuously; the quantum may not exceed the bucket's capacity
+type QuantumOption struct {
+	Quantum int64
+}
+
+func (me *QuantumOption) applyBucket(allopts *bucketOptions) {
+	allopts.quantum = me.Quantum
+}
+
+// Determines the order in which a limiter serves callers that have to wait
+type Fairness int
+
+const (
+	// Use the limiter's default ordering
+	// BasicConcLimiter defaults to FairnessFIFO and BasicRateLimiter to FairnessNone
+	FairnessDefault Fairness = iota
+	// Serve waiters strictly in the order they arrived
+	// A waiter is never overtaken, even by a later one that could be served straight away
+	FairnessFIFO
+	// Serve each waiter as soon as it can be, even ahead of waiters that arrived earlier
+	// BasicConcLimiter grants any waiter whose weight fits and BasicRateLimiter wakes each waiter on its own timer
+	FairnessNone
+)
+
+// option for controlling the order in which waiters are served
+// Applies to both BasicConcLimiter and BasicRateLimiter
+type FairnessOption struct {
+	Fairness Fairness
+}
+
+func (me *FairnessOption) applyBucket(allopts *bucketOptions) {
+	allopts.fairness = me.Fairness
+}
+
+func (me *FairnessOption) applyConc(allopts *concOptions) {
+	allopts.fairness = me.Fairness
+}
+
+// Base interface for options that configure a BasicConcLimiter
+type ConcOption interface {
+	applyConc(*concOptions)
+}
+
+// Contains all possible BasicConcLimiter options
+type concOptions struct {
+	fairness Fairness
+}
+
+// Creates an instance of concOptions out of a slice of ConcOptions
+func createConcOptions(opts ...ConcOption) *concOptions {
+	allOpts := &concOptions{}
+
+	for _, opt := range opts {
+		opt.applyConc(allOpts)
+	}
+
+	if allOpts.fairness == FairnessDefault {
+		allOpts.fairness = FairnessFIFO
+	}
+	return allOpts
+}
+
+// Base interface for options that configure a KeyedLimiter
+type KeyedOption interface {
+	applyKeyed(*keyedOptions)
+}
+
+// Contains all possible KeyedLimiter options
+type keyedOptions struct {
+	ttl     time.Duration
+	maxKeys int
+}
+
+// Creates an instance of keyedOptions out of a slice of KeyedOptions
+func createKeyedOptions(opts ...KeyedOption) *keyedOptions {
+	allOpts := &keyedOptions{}
+
+	for _, opt := range opts {
+		opt.applyKeyed(allOpts)
+	}
+	return allOpts
+}
+
+// option for evicting keys that have been idle for longer than TTL
+// By default keys are never evicted for being idle
+type KeyTTLOption struct {
+	TTL time.Duration
+}
+
+func (me *KeyTTLOption) applyKeyed(allopts *keyedOptions) {
+	allopts.ttl = me.TTL
+}
+
+// option for capping the number of keys
+// The least recently used idle key is evicted to make room for a new one
+// By default the number of keys is unlimited
+type MaxKeysOption struct {
+	Max int
+}
+
+func (me *MaxKeysOption) applyKeyed(allopts *keyedOptions) {
+	allopts.maxKeys = me.Max
+}
@@ -0,0 +1,37 @@
+package multilimiter
+
+import (
+	"context"
+	"sync/atomic"
+)
+
+// Describes how an executed function went so that adaptive limiters can adjust
+type Outcome int32
+
+const (
+	// The function completed normally
+	OutcomeSuccess Outcome = iota
+	// The function's work was dropped, e.g. it timed out or was rejected downstream
+	OutcomeDropped
+	// The function was told to slow down, e.g. by an HTTP 429 or a RESOURCE_EXHAUSTED error
+	OutcomeThrottled
+)
+
+// Implemented by limiters that adjust themselves from how executed functions went
+// BasicLimiter reports the outcome of every function it runs to its rate limiter if it implements this
+type OutcomeListener interface {
+	OnOutcome(outcome Outcome)
+}
+
+type outcomeKey struct{}
+
+// Records the outcome of the function that was given ctx by a limiter
+// Has no effect if ctx did not come from a limiter
+func ReportOutcome(ctx context.Context, outcome Outcome) {
+	if recorder, ok := ctx.Value(outcomeKey{}).(*atomic.Int32); ok {
+		recorder.Store(int32(outcome))
+	}
+}
+
+// Determines the outcome of a function from the error it returned
+type OutcomeClassifier func(err error) Outcome
@@ -0,0 +1,215 @@
+package multilimiter
+
+import (
+	"container/list"
+	"context"
+	"time"
+)
+
+// How important a caller is when waiting on a PriorityConcLimiter
+// Higher priorities are served first; values outside the configured lanes are clamped
+type Priority int
+
+const (
+	PriorityLow Priority = iota
+	PriorityNormal
+	PriorityHigh
+)
+
+type priorityKey struct{}
+
+// Returns a copy of ctx carrying priority
+// Pass it to BasicLimiter.Execute() and friends to choose a PriorityConcLimiter lane
+func WithPriority(ctx context.Context, priority Priority) context.Context {
+	return context.WithValue(ctx, priorityKey{}, priority)
+}
+
+// The priority carried by ctx or PriorityNormal if it has none
+func PriorityFromContext(ctx context.Context) Priority {
+	if priority, ok := ctx.Value(priorityKey{}).(Priority); ok {
+		return priority
+	}
+	return PriorityNormal
+}
+
+// Determines how a PriorityConcLimiter picks between lanes
+type PriorityScheduling int
+
+const (
+	// Always serve the highest priority lane that has waiters
+	PriorityStrict PriorityScheduling = iota
+	// Share slots between lanes in proportion to their weights
+	PriorityWeighted
+)
+
+// Controls how a PriorityConcLimiter orders waiters
+// Zero values use the defaults
+type PriorityPolicy struct {
+	// How lanes are picked; defaults to PriorityStrict
+	Scheduling PriorityScheduling
+	// The relative share of slots each lane gets under PriorityWeighted, lowest priority first
+	// The number of weights sets the number of lanes; defaults to 1, 2 and 4 for
+	// PriorityLow, PriorityNormal and PriorityHigh
+	Weights []int
+	// Waiters that have waited longer than MaxWait are served before all others, oldest first,
+	// so that low priority work cannot be starved; 0 disables this
+	MaxWait time.Duration
+}
+
+// A concurrency limiter that serves waiters by priority
+// The priority is taken from the context passed to Acquire(); see WithPriority()
+// Waiters of the same priority are served in the order they arrive
+type PriorityConcLimiter struct {
+	slotPool
+	lanes      []*priorityLane
+	waiting    int
+	scheduling PriorityScheduling
+	maxWait    time.Duration
+	// the pass of the lane most recently served under PriorityWeighted
+	vtime float64
+}
+
+// The waiters of one priority
+type priorityLane struct {
+	waiters list.List
+	// how far pass advances per slot granted under PriorityWeighted
+	stride float64
+	pass   float64
+}
+
+var _ ConcLimiter = (*PriorityConcLimiter)(nil)
+
+// Creates a new priority concurrency limiter
+// if size is <= 1, a default of 1 will be used
+// A nil policy uses the defaults
+func NewPriorityConcLimiter(size int, policy *PriorityPolicy) *PriorityConcLimiter {
+	if size <= 1 {
+		size = 1
+	}
+	if policy == nil {
+		policy = &PriorityPolicy{}
+	}
+	weights := policy.Weights
+	if len(weights) == 0 {
+		weights = []int{1, 2, 4}
+	}
+
+	lanes := make([]*priorityLane, len(weights))
+	for i, weight := range weights {
+		if weight < 1 {
+			weight = 1
+		}
+		lanes[i] = &priorityLane{stride: 1 / float64(weight)}
+	}
+
+	me := &PriorityConcLimiter{
+		slotPool:   slotPool{size: size, canceler: NewCanceler()},
+		lanes:      lanes,
+		scheduling: policy.Scheduling,
+		maxWait:    policy.MaxWait,
+	}
+	me.queue = me
+	return me
+}
+
+// Queues w in the lane for ctx's priority
+func (me *PriorityConcLimiter) push(ctx context.Context, w *concWaiter) {
+	lane := me.lane(PriorityFromContext(ctx))
+	if lane.waiters.Len() == 0 && lane.pass < me.vtime {
+		// a lane that was idle doesn't get to catch up on the share it didn't use
+		lane.pass = me.vtime
+	}
+	w.owner, w.elem = &lane.waiters, lane.waiters.PushBack(w)
+	me.waiting++
+}
+
+func (me *PriorityConcLimiter) remove(w *concWaiter) {
+	w.owner.Remove(w.elem)
+	me.waiting--
+}
+
+func (me *PriorityConcLimiter) len() int {
+	return me.waiting
+}
+
+// Grants slots to queued waiters in the order chosen by next()
+func (me *PriorityConcLimiter) serve(pool *slotPool) {
+	for me.waiting > 0 {
+		lane := me.next(time.Now())
+		front := lane.waiters.Front()
+		w := front.Value.(*concWaiter)
+		if !pool.grant(w) {
+			// stop at the chosen waiter if it doesn't fit so it isn't overtaken
+			return
+		}
+
+		lane.waiters.Remove(front)
+		me.waiting--
+		me.vtime = lane.pass
+		lane.pass += lane.stride * float64(w.n)
+	}
+}
+
+func (me *PriorityConcLimiter) removeIf(drop func(*concWaiter) bool) {
+	for _, lane := range me.lanes {
+		for e := lane.waiters.Front(); e != nil; {
+			next := e.Next()
+			if drop(e.Value.(*concWaiter)) {
+				lane.waiters.Remove(e)
+				me.waiting--
+			}
+			e = next
+		}
+	}
+}
+
+// Picks the lane whose first waiter should be served next
+// must be called with mu held and at least one waiter queued
+func (me *PriorityConcLimiter) next(now time.Time) *priorityLane {
+	var chosen *priorityLane
+
+	// waiters that have waited too long go first regardless of priority
+	if me.maxWait > 0 {
+		var oldest time.Time
+		for _, lane := range me.lanes {
+			front := lane.waiters.Front()
+			if front == nil {
+				continue
+			}
+			queued := front.Value.(*concWaiter).queued
+			if now.Sub(queued) >= me.maxWait && (chosen == nil || queued.Before(oldest)) {
+				chosen, oldest = lane, queued
+			}
+		}
+		if chosen != nil {
+			return chosen
+		}
+	}
+
+	// walk from the highest priority down so that ties go to the more important lane
+	for i := len(me.lanes) - 1; i >= 0; i-- {
+		lane := me.lanes[i]
+		if lane.waiters.Len() == 0 {
+			continue
+		}
+		if me.scheduling == PriorityStrict {
+			return lane
+		}
+		if chosen == nil || lane.pass < chosen.pass {
+			chosen = lane
+		}
+	}
+	return chosen
+}
+
+// The lane for priority, clamped to the configured lanes
+func (me *PriorityConcLimiter) lane(priority Priority) *priorityLane {
+	i := int(priority)
+	if i < 0 {
+		i = 0
+	}
+	if i >= len(me.lanes) {
+		i = len(me.lanes) - 1
+	}
+	return me.lanes[i]
+}
@@ -0,0 +1,143 @@
+package multilimiter_test
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jrboelens/multilimiter"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestPriorityConcLimiterSpec(t *testing.T) {
+
+	Convey("PriorityConcLimiter tests ", t, func() {
+		low := multilimiter.WithPriority(context.Background(), multilimiter.PriorityLow)
+		high := multilimiter.WithPriority(context.Background(), multilimiter.PriorityHigh)
+
+		Convey("the priority defaults to PriorityNormal", func() {
+			So(multilimiter.PriorityFromContext(context.Background()), ShouldEqual, multilimiter.PriorityNormal)
+			So(multilimiter.PriorityFromContext(high), ShouldEqual, multilimiter.PriorityHigh)
+		})
+
+		Convey("PriorityStrict serves higher priorities first", func() {
+			lim := multilimiter.NewPriorityConcLimiter(1, nil)
+			defer lim.Cancel()
+			recorder := HoldAndQueue(lim, map[string]context.Context{"L": low}, "L", "L")
+			recorder.Queue("H", high)
+			recorder.Queue("H", high)
+
+			So(recorder.Release(), ShouldEqual, "HHLL")
+		})
+
+		Convey("PriorityWeighted shares slots by weight", func() {
+			lim := multilimiter.NewPriorityConcLimiter(1, &multilimiter.PriorityPolicy{
+				Scheduling: multilimiter.PriorityWeighted,
+				Weights:    []int{1, 3},
+			})
+			defer lim.Cancel()
+			recorder := HoldAndQueue(lim, map[string]context.Context{"L": low, "H": high},
+				"L", "L", "L", "L", "H", "H", "H", "H", "H", "H", "H", "H")
+
+			So(recorder.Release(), ShouldEqual, "HLHHHLHHHLHL")
+		})
+
+		Convey("MaxWait keeps low priorities from starving", func() {
+			lim := multilimiter.NewPriorityConcLimiter(1, &multilimiter.PriorityPolicy{MaxWait: time.Millisecond * 20})
+			defer lim.Cancel()
+			recorder := HoldAndQueue(lim, map[string]context.Context{"L": low}, "L")
+			time.Sleep(time.Millisecond * 30)
+			recorder.Queue("H", high)
+			recorder.Queue("H", high)
+
+			So(recorder.Release(), ShouldEqual, "LHH")
+		})
+
+		Convey("SetConcurrency fails waiters that no longer fit and keeps serving by priority", func() {
+			lim := multilimiter.NewPriorityConcLimiter(3, nil)
+			defer lim.Cancel()
+			held, _ := lim.AcquireN(context.Background(), 3)
+
+			errs := make(chan error, 1)
+			go func() {
+				_, err := lim.AcquireN(high, 3)
+				errs <- err
+			}()
+			WaitForWaiters(lim, 1)
+
+			recorder := &AdmissionRecorder{lim: lim, held: held, queued: 1}
+			recorder.Queue("L", low)
+			recorder.Queue("H", high)
+
+			lim.SetConcurrency(1)
+			So(<-errs, ShouldEqual, multilimiter.WeightExceedsLimit)
+			So(lim.Concurrency(), ShouldEqual, 1)
+			So(lim.Waiting(), ShouldEqual, 2)
+
+			So(recorder.Release(), ShouldEqual, "HL")
+		})
+
+		Convey("waiters that give up leave the queue", func() {
+			lim := multilimiter.NewPriorityConcLimiter(1, nil)
+			defer lim.Cancel()
+			slot, _ := lim.Acquire(context.Background())
+
+			_, err := lim.Acquire(Context(time.Millisecond * 20))
+			So(err, ShouldMatchError, multilimiter.DeadlineExceeded)
+			So(lim.Waiting(), ShouldEqual, 0)
+
+			slot.Release()
+			_, ok := lim.TryAcquire()
+			So(ok, ShouldBeTrue)
+		})
+
+		Convey("Cancel wakes waiters", func() {
+			lim := multilimiter.NewPriorityConcLimiter(1, nil)
+			lim.Acquire(context.Background())
+			go func() {
+				time.Sleep(time.Millisecond * 10)
+				lim.Cancel()
+			}()
+
+			_, err := lim.Acquire(Context(time.Second))
+			So(err, ShouldMatchError, multilimiter.LimiterStopped)
+		})
+
+		Convey("AcquireN rejects weights larger than the concurrency", func() {
+			lim := multilimiter.NewPriorityConcLimiter(2, nil)
+			_, err := lim.AcquireN(context.Background(), 3)
+			So(err, ShouldMatchError, multilimiter.WeightExceedsLimit)
+		})
+
+		Convey("plugs in through ConcLimitOption", func() {
+			concLim := multilimiter.NewPriorityConcLimiter(1, nil)
+			lim := multilimiter.NewLimiter(
+				&multilimiter.ConcLimitOption{Limiter: concLim},
+				&multilimiter.RateLimitOption{Limiter: multilimiter.NewRateLimiter(0)},
+			)
+			defer lim.Stop()
+
+			release := make(chan struct{})
+			lim.Execute(context.Background(), func(context.Context) { <-release })
+
+			var mu sync.Mutex
+			var order []string
+			record := func(name string) func(context.Context) {
+				return func(context.Context) {
+					mu.Lock()
+					order = append(order, name)
+					mu.Unlock()
+				}
+			}
+			go lim.Execute(low, record("low"))
+			WaitForWaiters(concLim, 1)
+			go lim.Execute(high, record("high"))
+			WaitForWaiters(concLim, 2)
+
+			close(release)
+			lim.Wait()
+			So(order, ShouldResemble, []string{"high", "low"})
+		})
+	})
+}
@@ -0,0 +1,42 @@
+package promlimiter
+
+import "github.com/prometheus/client_golang/prometheus"
+
+const defaultNamespace = "multilimiter"
+
+type Option interface {
+	apply(*options)
+}
+
+type options struct {
+	namespace string
+	buckets   []float64
+}
+
+func createOptions(opts ...Option) *options {
+	allOpts := &options{namespace: defaultNamespace, buckets: prometheus.DefBuckets}
+	for _, opt := range opts {
+		opt.apply(allOpts)
+	}
+	return allOpts
+}
+
+// Prefixes every metric name
+// The default is "multilimiter"; an empty Namespace leaves names unprefixed
+type NamespaceOption struct {
+	Namespace string
+}
+
+func (me *NamespaceOption) apply(allOpts *options) {
+	allOpts.namespace = me.Namespace
+}
+
+// The buckets, in seconds, of the queue wait and task duration histograms
+// The default is prometheus.DefBuckets
+type BucketsOption struct {
+	Buckets []float64
+}
+
+func (me *BucketsOption) apply(allOpts *options) {
+	allOpts.buckets = me.Buckets
+}
@@ -0,0 +1,258 @@
+// Exports Prometheus metrics for multilimiter limiters
+//
+// A Collector holds the metrics for any number of limiters, each told apart by the "limiter" label
+// Register it with a prometheus.Registerer, then either:
+//   - pass Collector.Observer(name) to a BasicLimiter through multilimiter.ObserverOption, or
+//   - wrap any multilimiter.Limiter with Collector.Wrap(name, lim)
+//
+// Don't do both for the same limiter or everything will be counted twice
+package promlimiter
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/jrboelens/multilimiter"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const limiterLabel = "limiter"
+const reasonLabel = "reason"
+
+// A limiter whose configured concurrency and rate can be exported
+// *multilimiter.BasicLimiter satisfies this interface
+type Configured interface {
+	Concurrency() int
+	Rate() float64
+}
+
+// Ensure the Collector always meets the prometheus.Collector interface
+var _ prometheus.Collector = (*Collector)(nil)
+
+// A prometheus.Collector for the metrics of one or more limiters
+type Collector struct {
+	inFlight     *prometheus.GaugeVec
+	queueWait    *prometheus.HistogramVec
+	taskDuration *prometheus.HistogramVec
+	accepted     *prometheus.CounterVec
+	rejected     *prometheus.CounterVec
+	timeouts     *prometheus.CounterVec
+	panics       *prometheus.CounterVec
+	concurrency  *prometheus.Desc
+	rate         *prometheus.Desc
+
+	mu      sync.Mutex
+	tracked map[string]Configured
+}
+
+func NewCollector(opts ...Option) *Collector {
+	allOpts := createOptions(opts...)
+	ns := allOpts.namespace
+	limiter := []string{limiterLabel}
+
+	return &Collector{
+		inFlight: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: ns, Name: "in_flight",
+			Help: "Number of functions currently running under the limiter",
+		}, limiter),
+		queueWait: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: ns, Name: "queue_wait_seconds",
+			Help:    "Time callers waited to acquire concurrency and rate",
+			Buckets: allOpts.buckets,
+		}, limiter),
+		taskDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: ns, Name: "task_duration_seconds",
+			Help:    "Time functions ran for once admitted by the limiter",
+			Buckets: allOpts.buckets,
+		}, limiter),
+		accepted: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: ns, Name: "accepted_total",
+			Help: "Callers that acquired concurrency and rate",
+		}, limiter),
+		rejected: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: ns, Name: "rejected_total",
+			Help: "Callers turned away for a reason other than a timeout",
+		}, []string{limiterLabel, reasonLabel}),
+		timeouts: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: ns, Name: "timeouts_total",
+			Help: "Callers whose context ran out while waiting for concurrency and rate",
+		}, limiter),
+		panics: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: ns, Name: "panics_total",
+			Help: "Functions that panicked",
+		}, limiter),
+		concurrency: prometheus.NewDesc(prometheus.BuildFQName(ns, "", "concurrency"),
+			"Configured concurrency of the limiter", limiter, nil),
+		rate: prometheus.NewDesc(prometheus.BuildFQName(ns, "", "rate"),
+			"Configured rate of the limiter in tokens per second", limiter, nil),
+		tracked: map[string]Configured{},
+	}
+}
+
+func (me *Collector) vecs() []prometheus.Collector {
+	return []prometheus.Collector{me.inFlight, me.queueWait, me.taskDuration, me.accepted, me.rejected, me.timeouts, me.panics}
+}
+
+func (me *Collector) Describe(ch chan<- *prometheus.Desc) {
+	for _, vec := range me.vecs() {
+		vec.Describe(ch)
+	}
+	ch <- me.concurrency
+	ch <- me.rate
+}
+
+func (me *Collector) Collect(ch chan<- prometheus.Metric) {
+	for _, vec := range me.vecs() {
+		vec.Collect(ch)
+	}
+
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	for name, lim := range me.tracked {
+		ch <- prometheus.MustNewConstMetric(me.concurrency, prometheus.GaugeValue, float64(lim.Concurrency()), name)
+		ch <- prometheus.MustNewConstMetric(me.rate, prometheus.GaugeValue, lim.Rate(), name)
+	}
+}
+
+// Exports the configured concurrency and rate of lim under name
+// They are read each time metrics are collected so changes made while running are picked up
+func (me *Collector) Track(name string, lim Configured) {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	me.tracked[name] = lim
+}
+
+// Removes every metric exported under name, e.g. once a tenant's limiter is stopped
+func (me *Collector) Forget(name string) {
+	me.mu.Lock()
+	delete(me.tracked, name)
+	me.mu.Unlock()
+
+	labels := prometheus.Labels{limiterLabel: name}
+	me.inFlight.Delete(labels)
+	me.queueWait.Delete(labels)
+	me.taskDuration.Delete(labels)
+	me.accepted.Delete(labels)
+	me.rejected.DeletePartialMatch(labels)
+	me.timeouts.Delete(labels)
+	me.panics.Delete(labels)
+}
+
+// Creates an Observer that records metrics under name
+// Pass it to multilimiter.NewLimiter() with an ObserverOption and call Track() to export the limits too
+func (me *Collector) Observer(name string) *Observer {
+	return &Observer{
+		inFlight:     me.inFlight.WithLabelValues(name),
+		queueWait:    me.queueWait.WithLabelValues(name),
+		taskDuration: me.taskDuration.WithLabelValues(name),
+		accepted:     me.accepted.WithLabelValues(name),
+		rejected:     me.rejected.MustCurryWith(prometheus.Labels{limiterLabel: name}),
+		timeouts:     me.timeouts.WithLabelValues(name),
+		panics:       me.panics.WithLabelValues(name),
+	}
+}
+
+// Wraps lim so that every Execute() and Do() is recorded under name
+// Works with any Limiter; the limits are exported too if lim satisfies Configured
+func (me *Collector) Wrap(name string, lim multilimiter.Limiter) multilimiter.Limiter {
+	if configured, ok := lim.(Configured); ok {
+		me.Track(name, configured)
+	}
+	return &wrappedLimiter{Limiter: lim, observer: me.Observer(name)}
+}
+
+// Ensure the Observer always meets the multilimiter.Observer interface
+var _ multilimiter.Observer = (*Observer)(nil)
+
+// A multilimiter.Observer that records into a Collector's metrics
+type Observer struct {
+	inFlight     prometheus.Gauge
+	queueWait    prometheus.Observer
+	taskDuration prometheus.Observer
+	accepted     prometheus.Counter
+	rejected     *prometheus.CounterVec
+	timeouts     prometheus.Counter
+	panics       prometheus.Counter
+}
+
+func (me *Observer) OnAcquireStart() {}
+
+func (me *Observer) OnAcquire(waited time.Duration) {
+	me.accepted.Inc()
+	me.queueWait.Observe(waited.Seconds())
+}
+
+func (me *Observer) OnReject(reason multilimiter.RejectReason, err error) {
+	if reason == multilimiter.RejectTimeout {
+		me.timeouts.Inc()
+		return
+	}
+	me.rejected.WithLabelValues(string(reason)).Inc()
+}
+
+func (me *Observer) OnTaskStart() {
+	me.inFlight.Inc()
+}
+
+func (me *Observer) OnTaskEnd(duration time.Duration, panicked bool) {
+	me.inFlight.Dec()
+	me.taskDuration.Observe(duration.Seconds())
+	if panicked {
+		me.panics.Inc()
+	}
+}
+
+func (me *Observer) OnStop() {}
+
+// Records the calls made through a Limiter that can't take an Observer itself
+type wrappedLimiter struct {
+	multilimiter.Limiter
+	observer *Observer
+}
+
+func (me *wrappedLimiter) Execute(ctx context.Context, fn func(context.Context)) error {
+	started := time.Now()
+	err := me.Limiter.Execute(ctx, func(ctx context.Context) {
+		me.observer.OnAcquire(time.Since(started))
+		me.run(ctx, func(ctx context.Context) error {
+			fn(ctx)
+			return nil
+		})
+	})
+	return me.checkRejected(err)
+}
+
+func (me *wrappedLimiter) Do(ctx context.Context, fn func(context.Context) error) error {
+	started := time.Now()
+	// fn's own error must not be mistaken for a rejection
+	admitted := false
+	err := me.Limiter.Do(ctx, func(ctx context.Context) error {
+		admitted = true
+		me.observer.OnAcquire(time.Since(started))
+		return me.run(ctx, fn)
+	})
+	if admitted {
+		return err
+	}
+	return me.checkRejected(err)
+}
+
+// Runs fn as a task, recording it even if fn panics
+func (me *wrappedLimiter) run(ctx context.Context, fn func(context.Context) error) error {
+	me.observer.OnTaskStart()
+	started := time.Now()
+	panicked := true
+	defer func() { me.observer.OnTaskEnd(time.Since(started), panicked) }()
+
+	err := fn(ctx)
+	panicked = false
+	return err
+}
+
+func (me *wrappedLimiter) checkRejected(err error) error {
+	if err != nil {
+		me.observer.OnReject(multilimiter.RejectReasonOf(err), err)
+	}
+	return err
+}
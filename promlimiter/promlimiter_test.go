@@ -0,0 +1,207 @@
+package promlimiter_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/jrboelens/multilimiter"
+	"github.com/jrboelens/multilimiter/promlimiter"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestPromLimiterSpec(t *testing.T) {
+	Convey("Collector", t, func() {
+		collector := promlimiter.NewCollector()
+		reg := prometheus.NewPedanticRegistry()
+		So(reg.Register(collector), ShouldBeNil)
+
+		newLimiter := func(opts ...multilimiter.Option) *multilimiter.BasicLimiter {
+			opts = append(opts,
+				&multilimiter.ConcLimitOption{Limiter: multilimiter.NewConcLimiter(2)},
+				&multilimiter.RateLimitOption{Limiter: multilimiter.NewRateLimiter(50)},
+			)
+			return multilimiter.NewLimiter(opts...)
+		}
+
+		Convey("as an observer", func() {
+			lim := newLimiter(&multilimiter.ObserverOption{Observer: collector.Observer("api")})
+			defer lim.Stop()
+			collector.Track("api", lim)
+
+			Convey("exports the configured limits", func() {
+				So(Value(reg, "multilimiter_concurrency", "api"), ShouldEqual, 2)
+				So(Value(reg, "multilimiter_rate", "api"), ShouldEqual, 50)
+			})
+
+			Convey("counts accepted callers and times their tasks", func() {
+				for i := 0; i < 3; i++ {
+					lim.Execute(Context(time.Second), func(context.Context) { time.Sleep(time.Millisecond * 10) })
+				}
+				lim.Wait()
+
+				So(Value(reg, "multilimiter_accepted_total", "api"), ShouldEqual, 3)
+				So(SampleCount(reg, "multilimiter_queue_wait_seconds", "api"), ShouldEqual, 3)
+				So(SampleCount(reg, "multilimiter_task_duration_seconds", "api"), ShouldEqual, 3)
+				So(Value(reg, "multilimiter_in_flight", "api"), ShouldEqual, 0)
+			})
+
+			Convey("reports functions that are running", func() {
+				release := make(chan struct{})
+				lim.Execute(Context(time.Second), func(context.Context) { <-release })
+				time.Sleep(time.Millisecond * 10)
+
+				So(Value(reg, "multilimiter_in_flight", "api"), ShouldEqual, 1)
+				close(release)
+				lim.Wait()
+				So(Value(reg, "multilimiter_in_flight", "api"), ShouldEqual, 0)
+			})
+
+			Convey("counts timeouts and rejections separately", func() {
+				release := make(chan struct{})
+				defer close(release)
+				lim.ExecuteN(Context(time.Second), 1, 2, func(context.Context) { <-release })
+
+				lim.Execute(Context(time.Millisecond*10), func(context.Context) {})
+				ctx, cancel := context.WithCancel(context.Background())
+				time.AfterFunc(time.Millisecond*10, cancel)
+				lim.Execute(ctx, func(context.Context) {})
+				lim.ExecuteN(Context(time.Second), 1, 3, func(context.Context) {})
+				lim.Stop()
+				lim.Execute(Context(time.Second), func(context.Context) {})
+
+				So(Value(reg, "multilimiter_timeouts_total", "api"), ShouldEqual, 1)
+				So(Value(reg, "multilimiter_rejected_total", "api", string(multilimiter.RejectCanceled)), ShouldEqual, 1)
+				So(Value(reg, "multilimiter_rejected_total", "api", string(multilimiter.RejectWeight)), ShouldEqual, 1)
+				So(Value(reg, "multilimiter_rejected_total", "api", string(multilimiter.RejectStopped)), ShouldEqual, 1)
+			})
+
+			Convey("counts panics", func() {
+				So(func() {
+					lim.Do(Context(time.Second), func(context.Context) error { panic("boom") })
+				}, ShouldPanic)
+				So(Value(reg, "multilimiter_panics_total", "api"), ShouldEqual, 1)
+			})
+
+			Convey("Forget removes the limiter's metrics", func() {
+				lim.Do(Context(time.Second), func(context.Context) error { return nil })
+				collector.Forget("api")
+
+				So(Value(reg, "multilimiter_accepted_total", "api"), ShouldEqual, -1)
+				So(Value(reg, "multilimiter_concurrency", "api"), ShouldEqual, -1)
+			})
+		})
+
+		Convey("as a wrapper", func() {
+			inner := newLimiter()
+			defer inner.Stop()
+			lim := collector.Wrap("wrapped", inner)
+
+			Convey("exports the limits of a BasicLimiter", func() {
+				So(Value(reg, "multilimiter_concurrency", "wrapped"), ShouldEqual, 2)
+			})
+
+			Convey("counts accepted callers and times their tasks", func() {
+				lim.Execute(Context(time.Second), func(context.Context) {})
+				lim.Do(Context(time.Second), func(context.Context) error { return nil })
+				lim.Wait()
+
+				So(Value(reg, "multilimiter_accepted_total", "wrapped"), ShouldEqual, 2)
+				So(SampleCount(reg, "multilimiter_task_duration_seconds", "wrapped"), ShouldEqual, 2)
+				So(Value(reg, "multilimiter_in_flight", "wrapped"), ShouldEqual, 0)
+			})
+
+			Convey("does not count fn's own error as a rejection", func() {
+				err := lim.Do(Context(time.Second), func(context.Context) error { return context.DeadlineExceeded })
+				So(errors.Is(err, context.DeadlineExceeded), ShouldBeTrue)
+				So(Value(reg, "multilimiter_timeouts_total", "wrapped"), ShouldEqual, 0)
+			})
+
+			Convey("counts rejections", func() {
+				inner.Stop()
+				So(lim.Execute(Context(time.Second), func(context.Context) {}), ShouldNotBeNil)
+				So(Value(reg, "multilimiter_rejected_total", "wrapped", string(multilimiter.RejectStopped)), ShouldEqual, 1)
+			})
+
+			Convey("counts panics and lets them through", func() {
+				So(func() {
+					lim.Do(Context(time.Second), func(context.Context) error { panic("boom") })
+				}, ShouldPanic)
+				So(Value(reg, "multilimiter_panics_total", "wrapped"), ShouldEqual, 1)
+			})
+		})
+
+		Convey("NamespaceOption changes the metric names", func() {
+			collector := promlimiter.NewCollector(&promlimiter.NamespaceOption{Namespace: "tenants"})
+			reg := prometheus.NewPedanticRegistry()
+			So(reg.Register(collector), ShouldBeNil)
+			collector.Track("a", newLimiter())
+
+			So(Value(reg, "tenants_concurrency", "a"), ShouldEqual, 2)
+		})
+	})
+}
+
+func ContextWithCancel(timeout time.Duration) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), timeout)
+}
+
+func Context(timeout time.Duration) context.Context {
+	ctx, _ := ContextWithCancel(timeout)
+	return ctx
+}
+
+// Finds the metric with the given label values, in label name order
+func find(reg prometheus.Gatherer, name string, labelValues ...string) *dto.Metric {
+	families, err := reg.Gather()
+	So(err, ShouldBeNil)
+	for _, family := range families {
+		if family.GetName() != name {
+			continue
+		}
+		for _, metric := range family.GetMetric() {
+			if matches(metric, labelValues) {
+				return metric
+			}
+		}
+	}
+	return nil
+}
+
+func matches(metric *dto.Metric, labelValues []string) bool {
+	labels := metric.GetLabel()
+	if len(labels) != len(labelValues) {
+		return false
+	}
+	for i, label := range labels {
+		if label.GetValue() != labelValues[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// The value of a counter or gauge, or -1 if it isn't exported
+func Value(reg prometheus.Gatherer, name string, labelValues ...string) float64 {
+	metric := find(reg, name, labelValues...)
+	switch {
+	case metric == nil:
+		return -1
+	case metric.Counter != nil:
+		return metric.Counter.GetValue()
+	default:
+		return metric.Gauge.GetValue()
+	}
+}
+
+// The number of observations made by a histogram
+func SampleCount(reg prometheus.Gatherer, name string, labelValues ...string) uint64 {
+	metric := find(reg, name, labelValues...)
+	if metric == nil {
+		return 0
+	}
+	return metric.Histogram.GetSampleCount()
+}
@@ -0,0 +1,169 @@
+package multilimiter
+
+import (
+	"container/list"
+	"context"
+	"math"
+	"sync"
+	"time"
+)
+
+const defaultCoDelTarget = 5 * time.Millisecond
+const defaultCoDelInterval = 100 * time.Millisecond
+
+// Tracks the callers waiting on a BasicLimiter and sheds them according to the queue options
+type admissionQueue struct {
+	maxLength int
+	policy    QueuePolicy
+	timeout   time.Duration
+	target    time.Duration
+	interval  time.Duration
+	mu        sync.Mutex
+	// the waiting callers, oldest first
+	waiters list.List
+	// QueueCoDel's state; see RFC 8289
+	firstAbove time.Time
+	dropping   bool
+	dropNext   time.Time
+	count      int
+	lastCount  int
+}
+
+// A caller waiting in an admissionQueue
+type queuedCaller struct {
+	cancel context.CancelCauseFunc
+	since  time.Time
+}
+
+// Returns nil if queueing isn't limited
+func newAdmissionQueue(length *MaxQueueLengthOption, timeout *QueueTimeoutOption) *admissionQueue {
+	if length == nil && timeout == nil {
+		return nil
+	}
+
+	me := &admissionQueue{}
+	if timeout != nil {
+		me.timeout = timeout.Timeout
+	}
+	if length != nil {
+		me.maxLength = length.Length
+		me.policy = length.Policy
+		me.target = length.Target
+		me.interval = length.Interval
+	}
+	if me.target <= 0 {
+		me.target = defaultCoDelTarget
+	}
+	if me.interval <= 0 {
+		me.interval = defaultCoDelInterval
+	}
+	return me
+}
+
+// Admits a caller to the queue
+// The returned context must be used while waiting and the returned func called once done waiting
+// with whether the caller acquired what it was waiting for
+// A caller that is shed has its context canceled with ErrQueueFull as the cause
+func (me *admissionQueue) enter(ctx context.Context) (context.Context, func(admitted bool), error) {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+
+	if me.maxLength > 0 && me.waiters.Len() >= me.maxLength {
+		if me.policy != QueueDropOldest {
+			return nil, nil, ErrQueueFull
+		}
+		me.shedOldest()
+	}
+
+	ctx, cancel := context.WithCancelCause(ctx)
+	cleanup := []func(){func() { cancel(nil) }}
+	if me.timeout > 0 {
+		var stop context.CancelFunc
+		ctx, stop = context.WithTimeout(ctx, me.timeout)
+		cleanup = append(cleanup, stop)
+	}
+
+	elem := me.waiters.PushBack(&queuedCaller{cancel: cancel, since: time.Now()})
+	return ctx, func(admitted bool) {
+		me.leave(elem, admitted)
+		for _, fn := range cleanup {
+			fn()
+		}
+	}, nil
+}
+
+func (me *admissionQueue) leave(elem *list.Element, admitted bool) {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+
+	// removing a caller that was already shed has no effect
+	me.waiters.Remove(elem)
+	if admitted && me.policy == QueueCoDel {
+		now := time.Now()
+		me.dequeued(now, now.Sub(elem.Value.(*queuedCaller).since))
+	}
+}
+
+// Applies the CoDel control law as a caller that waited for sojourn is admitted
+// Once waits have stayed above target for a whole interval the oldest callers are shed,
+// more often the longer that lasts, until a wait falls below target again
+// must be called with mu held
+func (me *admissionQueue) dequeued(now time.Time, sojourn time.Duration) {
+	okToDrop := me.aboveTarget(now, sojourn)
+
+	switch {
+	case me.dropping && !okToDrop:
+		me.dropping = false
+	case me.dropping:
+		for !now.Before(me.dropNext) {
+			if !me.shedOldest() {
+				me.dropping = false
+				return
+			}
+			me.count++
+			me.dropNext = me.controlLaw(me.dropNext)
+		}
+	case okToDrop:
+		me.shedOldest()
+		me.dropping = true
+		// if dropping stopped only recently carry on near the rate it had reached
+		if delta := me.count - me.lastCount; delta > 1 && now.Sub(me.dropNext) < 16*me.interval {
+			me.count = delta
+		} else {
+			me.count = 1
+		}
+		me.lastCount = me.count
+		me.dropNext = me.controlLaw(now)
+	}
+}
+
+// Whether waits have been above target for at least an interval
+// must be called with mu held
+func (me *admissionQueue) aboveTarget(now time.Time, sojourn time.Duration) bool {
+	if sojourn < me.target || me.waiters.Len() == 0 {
+		me.firstAbove = time.Time{}
+		return false
+	}
+	if me.firstAbove.IsZero() {
+		me.firstAbove = now.Add(me.interval)
+		return false
+	}
+	return !now.Before(me.firstAbove)
+}
+
+// When to shed next; the gap shrinks with the square root of the number shed so far
+func (me *admissionQueue) controlLaw(t time.Time) time.Time {
+	return t.Add(time.Duration(float64(me.interval) / math.Sqrt(float64(me.count))))
+}
+
+// Sheds the caller that has waited longest, returning false if nobody is waiting
+// must be called with mu held
+func (me *admissionQueue) shedOldest() bool {
+	front := me.waiters.Front()
+	if front == nil {
+		return false
+	}
+	me.waiters.Remove(front)
+	front.Value.(*queuedCaller).cancel(ErrQueueFull)
+	return true
+}
@@ -2,19 +2,32 @@ package multilimiter
 
 import (
 	"context"
+	"math"
 	"time"
-
-	"github.com/juju/ratelimit"
 )
 
+const infiniteDuration = time.Duration(math.MaxInt64)
+
 type RateLimiter interface {
 	// Wait until there are resources available
-	// only DeadlineExceeded and LimiterStopped errors can be returned
+	// only errors matching DeadlineExceeded and LimiterStopped can be returned
 	Wait(ctx context.Context) error
+	// Wait until tokens resources are available
+	// only errors matching DeadlineExceeded and LimiterStopped can be returned
+	// along with WeightExceedsLimit from limiters that cap how many tokens can be taken at once
+	WaitN(ctx context.Context, tokens int64) error
+	// Take a token only if one is available right now
+	Allow() bool
+	// Take tokens now and report how long to wait before using them
+	// Canceling the Reservation returns the tokens
+	Reserve(tokens int64) Reservation
 	// The configured rate
 	Rate() float64
 	// Cancels Wait()ing
 	Cancel()
+	// The number of tokens that can currently be taken without waiting
+	// This may be negative when callers are already waiting on future tokens
+	Available() int64
 }
 
 type TestableRateLimiter interface {
@@ -23,20 +36,46 @@ type TestableRateLimiter interface {
 }
 
 type BasicRateLimiter struct {
-	rate     float64
-	bucket   *ratelimit.Bucket
+	bucket   *tokenBucket
 	canceler *Canceler
+	// orders waiters under FairnessFIFO; nil otherwise
+	queue *fifoQueue
 }
 
 var _ RateLimiter = (*BasicRateLimiter)(nil)
 
-// Returns a *BasicRateLimiter if rate > 0; otherwise a *NoLimitRateLimiter
-func NewRateLimiter(rate float64) RateLimiter {
-	if rate <= 0 {
-		return &NoLimitRateLimiter{}
+// Returns a *BasicRateLimiter; a rate <= 0 means no limit until a positive rate is set with SetRate()
+// opts configure the underlying token bucket's burst capacity, initial fill level and quantum
+// Panics if rate or opts are invalid; use NewBasicRateLimiter() to get an error instead
+func NewRateLimiter(rate float64, opts ...BucketOption) RateLimiter {
+	lim, err := NewBasicRateLimiter(rate, opts...)
+	if err != nil {
+		panic(err)
 	}
-	bucket := ratelimit.NewBucketWithRate(rate, int64(2))
-	return &BasicRateLimiter{rate: rate, bucket: bucket, canceler: NewCanceler()}
+	return lim
+}
+
+// Creates a token bucket rate limiter whose rate can be changed with SetRate()
+// A rate <= 0 means no limit until a positive rate is set
+// An error matching InvalidBucketConfig is returned if rate isn't finite or the quantum exceeds the capacity
+func NewBasicRateLimiter(rate float64, opts ...BucketOption) (*BasicRateLimiter, error) {
+	bucketOpts := createBucketOptions(opts...)
+	now := time.Now()
+	bucket, err := newTokenBucket(now, rate, bucketOpts.capacity, bucketOpts.quantum)
+	if err != nil {
+		return nil, err
+	}
+
+	// buckets start full so drain whatever shouldn't be there
+	if bucketOpts.initial != nil {
+		bucket.takeAvailable(now, bucketOpts.capacity-*bucketOpts.initial)
+	}
+
+	lim := &BasicRateLimiter{bucket: bucket, canceler: NewCanceler()}
+	if bucketOpts.fairness == FairnessFIFO {
+		lim.queue = &fifoQueue{}
+	}
+	return lim, nil
 }
 
 // This allows us to force a timeout in testing by setting the number of desired tokens to a high value
@@ -48,26 +87,103 @@ func (me *BasicRateLimiter) Wait(ctx context.Context) error {
 	return me.wait(1, ctx)
 }
 
+// Wait until tokens resources are available
+// if tokens is < 1 nothing is taken and no waiting occurs
+func (me *BasicRateLimiter) WaitN(ctx context.Context, tokens int64) error {
+	return me.wait(tokens, ctx)
+}
+
 func (me *BasicRateLimiter) wait(tokens int64, ctx context.Context) error {
 	if me.canceler.IsCanceled() {
 		return LimiterStopped
 	}
+	if tokens < 1 {
+		return nil
+	}
+
+	return me.Reserve(tokens).Wait(ctx)
+}
 
-	if d := me.bucket.Take(tokens); d > 0 {
-		select {
-		case <-me.canceler.Done():
-			return LimiterStopped
-		case <-ctx.Done():
-			return DeadlineExceeded
-		case <-time.After(d):
-			return nil
-		}
+// Take tokens now and report how long to wait before using them
+// Canceling the Reservation returns the tokens so throughput isn't lost when callers give up
+func (me *BasicRateLimiter) Reserve(tokens int64) Reservation {
+	if me.canceler.IsCanceled() {
+		return stoppedReservation{}
+	}
+
+	var timeToAct time.Time
+	var rate float64
+	var seq uint64
+	take := func() {
+		timeToAct, rate, _ = me.bucket.take(time.Now(), tokens, infiniteDuration)
+	}
+	if me.queue != nil {
+		seq = me.queue.ticket(take)
+	} else {
+		take()
+	}
+	if rate <= 0 {
+		// nothing was taken so there is nothing to wait for or refund
+		return immediateReservation{}
+	}
+
+	return &bucketReservation{
+		bucket:    me.bucket,
+		tokens:    tokens,
+		done:      me.canceler.Done(),
+		timeToAct: timeToAct,
+		rate:      rate,
+		queue:     me.queue,
+		seq:       seq,
 	}
-	return nil
+}
+
+// Take a token only if one is available right now
+// Returns false if the limiter is canceled or, under FIFO, other callers are already waiting
+func (me *BasicRateLimiter) Allow() bool {
+	if me.canceler.IsCanceled() {
+		return false
+	}
+	if me.queue != nil && me.queue.len() > 0 {
+		return false
+	}
+	return me.bucket.takeAvailable(time.Now(), 1) == 1
 }
 
 func (me *BasicRateLimiter) Rate() float64 {
-	return me.rate
+	rate, _ := me.bucket.currentRate()
+	if rate < 0 {
+		return 0
+	}
+	return rate
+}
+
+// Changes the rate while the limiter is in use
+// Tokens that have already accrued are kept and callers blocked in Wait() are rescheduled
+// to spend the rest of their wait at the new rate
+// A rate <= 0 removes the limit until a positive rate is set
+// An error matching InvalidBucketConfig is returned, and the rate left alone, if rate isn't finite
+func (me *BasicRateLimiter) SetRate(rate float64) error {
+	return me.bucket.setRate(time.Now(), rate)
+}
+
+// Changes how many tokens can accumulate
+// if capacity is < 1, DEFAULT_BURST will be used
+// An error matching InvalidBucketConfig is returned, and the capacity left alone, if it is smaller than the quantum
+func (me *BasicRateLimiter) SetBurst(capacity int64) error {
+	if capacity < 1 {
+		capacity = DEFAULT_BURST
+	}
+	return me.bucket.setCapacity(time.Now(), capacity)
+}
+
+// The maximum number of tokens the bucket can hold
+func (me *BasicRateLimiter) Capacity() int64 {
+	return me.bucket.size()
+}
+
+func (me *BasicRateLimiter) Available() int64 {
+	return me.bucket.available(time.Now())
 }
 
 func (me *BasicRateLimiter) Cancel() {
@@ -75,6 +191,7 @@ func (me *BasicRateLimiter) Cancel() {
 }
 
 // A Null implementation of RateLimiter
+// NewRateLimiter(0) returns an unlimited *BasicRateLimiter instead so that a rate can be set later
 type NoLimitRateLimiter struct{}
 
 var _ RateLimiter = (*NoLimitRateLimiter)(nil)
@@ -83,8 +200,25 @@ func (me *NoLimitRateLimiter) Wait(ctx context.Context) error {
 	return nil
 }
 
+func (me *NoLimitRateLimiter) WaitN(ctx context.Context, tokens int64) error {
+	return nil
+}
+
+func (me *NoLimitRateLimiter) Allow() bool {
+	return true
+}
+
+func (me *NoLimitRateLimiter) Reserve(tokens int64) Reservation {
+	return immediateReservation{}
+}
+
 func (me *NoLimitRateLimiter) Rate() float64 {
 	return 0.0
 }
 
 func (me *NoLimitRateLimiter) Cancel() {}
+
+// Always returns math.MaxInt64 since there is no limit
+func (me *NoLimitRateLimiter) Available() int64 {
+	return math.MaxInt64
+}
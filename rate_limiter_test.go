@@ -1,6 +1,10 @@
 package multilimiter_test
 
 import (
+	"context"
+	"errors"
+	"math"
+	"sync"
 	"testing"
 	"time"
 
@@ -30,7 +34,7 @@ func TestRateLimiterSpec(t *testing.T) {
 			lim.Cancel()
 
 			err = lim.Wait(Context(timeout))
-			So(err, ShouldEqual, multilimiter.LimiterStopped)
+			So(err, ShouldMatchError, multilimiter.LimiterStopped)
 		})
 
 		Convey("Wait adheres to a timeout", func() {
@@ -43,7 +47,296 @@ func TestRateLimiterSpec(t *testing.T) {
 			// this test forces a long wait on the tokens in order to trigger the timeout
 			typedLim := lim.(multilimiter.TestableRateLimiter)
 			err := typedLim.XXX_TEST_Wait(100, Context(timeout))
-			So(err, ShouldEqual, multilimiter.DeadlineExceeded)
+			So(err, ShouldMatchError, multilimiter.DeadlineExceeded)
+		})
+
+		Convey("WaitN takes multiple tokens", func() {
+			lim := multilimiter.NewRateLimiter(1.0)
+
+			// the bucket starts with 2 tokens
+			err := lim.WaitN(Context(time.Millisecond*20), 2)
+			So(err, ShouldBeNil)
+
+			err = lim.WaitN(Context(time.Millisecond*20), 2)
+			So(err, ShouldMatchError, multilimiter.DeadlineExceeded)
+		})
+
+		Convey("WaitN with no tokens does not wait", func() {
+			lim := multilimiter.NewRateLimiter(1.0)
+			lim.WaitN(Context(time.Millisecond*20), 100)
+
+			err := lim.WaitN(Context(time.Millisecond*20), 0)
+			So(err, ShouldBeNil)
+		})
+
+		Convey("bucket options", func() {
+			timeout := time.Millisecond * 20
+
+			Convey("BurstOption allows bursts up to the capacity", func() {
+				lim := multilimiter.NewRateLimiter(1.0, &multilimiter.BurstOption{Capacity: 10})
+				So(lim.Available(), ShouldEqual, 10)
+
+				for i := 0; i < 10; i++ {
+					So(lim.Wait(Context(timeout)), ShouldBeNil)
+				}
+				So(lim.Wait(Context(timeout)), ShouldMatchError, multilimiter.DeadlineExceeded)
+			})
+
+			Convey("InitialTokensOption sets the starting fill level", func() {
+				lim := multilimiter.NewRateLimiter(1.0,
+					&multilimiter.BurstOption{Capacity: 10},
+					&multilimiter.InitialTokensOption{Tokens: 3},
+				)
+				So(lim.Available(), ShouldEqual, 3)
+
+				lim = multilimiter.NewRateLimiter(1.0, &multilimiter.InitialTokensOption{Tokens: 0})
+				So(lim.Available(), ShouldEqual, 0)
+				So(lim.Wait(Context(timeout)), ShouldMatchError, multilimiter.DeadlineExceeded)
+			})
+
+			Convey("QuantumOption adds tokens in batches", func() {
+				lim := multilimiter.NewRateLimiter(100.0,
+					&multilimiter.BurstOption{Capacity: 5},
+					&multilimiter.InitialTokensOption{Tokens: 0},
+					&multilimiter.QuantumOption{Quantum: 5},
+				)
+
+				// 5 tokens arrive together after 50ms
+				time.Sleep(time.Millisecond * 60)
+				So(lim.Available(), ShouldEqual, 5)
+			})
+
+			Convey("very small rates wait rather than failing", func() {
+				lim := multilimiter.NewRateLimiter(1e-12, &multilimiter.InitialTokensOption{Tokens: 0})
+				res := lim.Reserve(1)
+				So(res.Delay(), ShouldBeGreaterThan, time.Hour)
+				res.Cancel()
+				So(lim.Wait(Context(timeout)), ShouldMatchError, multilimiter.DeadlineExceeded)
+				So(lim.Available(), ShouldEqual, 0)
+			})
+
+			Convey("QuantumOption works at rates above one token per nanosecond", func() {
+				lim := multilimiter.NewRateLimiter(1e12,
+					&multilimiter.BurstOption{Capacity: 10},
+					&multilimiter.QuantumOption{Quantum: 1},
+				)
+				for i := 0; i < 100; i++ {
+					So(lim.Wait(Context(timeout)), ShouldBeNil)
+				}
+			})
+
+			Convey("invalid configurations are reported", func() {
+				_, err := multilimiter.NewBasicRateLimiter(math.NaN())
+				So(err, ShouldMatchError, multilimiter.InvalidBucketConfig)
+
+				_, err = multilimiter.NewBasicRateLimiter(1.0, &multilimiter.BurstOption{Capacity: 10}, &multilimiter.QuantumOption{Quantum: 20})
+				So(err, ShouldMatchError, multilimiter.InvalidBucketConfig)
+				So(func() { multilimiter.NewRateLimiter(math.Inf(1)) }, ShouldPanic)
+
+				lim := NewBucketRateLimiter(1.0, &multilimiter.BurstOption{Capacity: 10}, &multilimiter.QuantumOption{Quantum: 5})
+				So(lim.SetRate(math.Inf(1)), ShouldMatchError, multilimiter.InvalidBucketConfig)
+				So(lim.Rate(), ShouldEqual, 1.0)
+				So(lim.SetBurst(4), ShouldMatchError, multilimiter.InvalidBucketConfig)
+				So(lim.Capacity(), ShouldEqual, 10)
+			})
+
+			Convey("the default burst capacity is preserved", func() {
+				lim := multilimiter.NewRateLimiter(DEFAULT_RATE)
+				So(lim.(*multilimiter.BasicRateLimiter).Capacity(), ShouldEqual, multilimiter.DEFAULT_BURST)
+			})
+		})
+
+		Convey("Allow", func() {
+			Convey("takes a token only when one is available", func() {
+				lim := multilimiter.NewRateLimiter(1.0)
+				So(lim.Allow(), ShouldBeTrue)
+				So(lim.Allow(), ShouldBeTrue)
+				So(lim.Allow(), ShouldBeFalse)
+				So(lim.Available(), ShouldEqual, 0)
+			})
+
+			Convey("always succeeds without a limit", func() {
+				lim := multilimiter.NewRateLimiter(0)
+				So(lim.Allow(), ShouldBeTrue)
+			})
+
+			Convey("fails once canceled", func() {
+				lim := multilimiter.NewRateLimiter(DEFAULT_RATE)
+				lim.Cancel()
+				So(lim.Allow(), ShouldBeFalse)
+			})
+		})
+
+		Convey("Reserve", func() {
+			Convey("reports the delay before the tokens can be used", func() {
+				lim := multilimiter.NewRateLimiter(10.0)
+
+				res := lim.Reserve(2)
+				So(res.OK(), ShouldBeTrue)
+				So(res.Delay(), ShouldEqual, 0)
+
+				res = lim.Reserve(5)
+				So(res.Delay(), ShouldBeBetween, time.Millisecond*400, time.Millisecond*500)
+			})
+
+			Convey("Cancel returns the tokens", func() {
+				lim := multilimiter.NewRateLimiter(1.0)
+				lim.Reserve(2)
+
+				res := lim.Reserve(3)
+				So(lim.Available(), ShouldEqual, -3)
+
+				res.Cancel()
+				So(lim.Available(), ShouldEqual, 0)
+
+				// canceling again has no effect
+				res.Cancel()
+				So(lim.Available(), ShouldEqual, 0)
+			})
+
+			Convey("Wait refunds the tokens when the context is canceled", func() {
+				lim := multilimiter.NewRateLimiter(1.0)
+				lim.Reserve(2)
+
+				ctx, cancel := ContextWithCancel(0)
+				go func() {
+					time.Sleep(time.Millisecond * 20)
+					cancel()
+				}()
+
+				err := lim.WaitN(ctx, 1)
+				So(err, ShouldMatchError, multilimiter.DeadlineExceeded)
+				So(lim.Available(), ShouldEqual, 0)
+			})
+
+			Convey("Wait fails fast when the deadline falls before the delay", func() {
+				lim := multilimiter.NewRateLimiter(1.0)
+				lim.Reserve(2)
+
+				start := time.Now()
+				err := lim.Wait(Context(time.Millisecond * 500))
+				So(err, ShouldMatchError, multilimiter.DeadlineExceeded)
+				So(time.Since(start), ShouldBeLessThan, time.Millisecond*100)
+				So(lim.Available(), ShouldEqual, 0)
+			})
+
+			Convey("is not OK once canceled", func() {
+				lim := multilimiter.NewRateLimiter(DEFAULT_RATE)
+				lim.Cancel()
+
+				res := lim.Reserve(1)
+				So(res.OK(), ShouldBeFalse)
+				So(res.Wait(Context(time.Millisecond*20)), ShouldMatchError, multilimiter.LimiterStopped)
+			})
+
+			Convey("is immediate without a limit", func() {
+				lim := multilimiter.NewRateLimiter(0)
+				res := lim.Reserve(1000)
+				So(res.OK(), ShouldBeTrue)
+				So(res.Delay(), ShouldEqual, 0)
+			})
+		})
+
+		Convey("SetRate", func() {
+			Convey("reschedules callers that are already waiting", func() {
+				lim := NewBucketRateLimiter(1.0)
+				lim.Reserve(2)
+
+				go func() {
+					time.Sleep(time.Millisecond * 20)
+					lim.SetRate(100.0)
+				}()
+
+				start := time.Now()
+				err := lim.Wait(Context(time.Second * 2))
+				So(err, ShouldBeNil)
+				So(time.Since(start), ShouldBeLessThan, time.Millisecond*200)
+				So(lim.Rate(), ShouldEqual, 100.0)
+			})
+
+			Convey("keeps the tokens that have accrued", func() {
+				lim := NewBucketRateLimiter(1.0,
+					&multilimiter.BurstOption{Capacity: 10},
+					&multilimiter.InitialTokensOption{Tokens: 5},
+				)
+				lim.SetRate(2.0)
+				So(lim.Available(), ShouldEqual, 5)
+			})
+
+			Convey("to zero removes the limit and releases waiters", func() {
+				lim := NewBucketRateLimiter(1.0)
+				lim.Reserve(2)
+
+				go func() {
+					time.Sleep(time.Millisecond * 20)
+					lim.SetRate(0)
+				}()
+
+				So(lim.Wait(Context(time.Second*2)), ShouldBeNil)
+				So(lim.Rate(), ShouldEqual, 0)
+				for i := 0; i < 10; i++ {
+					So(lim.Allow(), ShouldBeTrue)
+				}
+			})
+
+			Convey("from zero starts limiting with a full bucket", func() {
+				lim := NewBucketRateLimiter(0)
+				So(lim.Wait(Context(time.Millisecond*20)), ShouldBeNil)
+				So(lim.Available(), ShouldEqual, math.MaxInt64)
+
+				lim.SetRate(1.0)
+				So(lim.Available(), ShouldEqual, multilimiter.DEFAULT_BURST)
+				So(lim.Allow(), ShouldBeTrue)
+				So(lim.Allow(), ShouldBeTrue)
+				So(lim.Allow(), ShouldBeFalse)
+			})
+		})
+
+		Convey("NewRateLimiter without a rate can be given one later", func() {
+			lim, ok := multilimiter.NewRateLimiter(0).(*multilimiter.BasicRateLimiter)
+			So(ok, ShouldBeTrue)
+			So(lim.Allow(), ShouldBeTrue)
+
+			So(lim.SetRate(1.0), ShouldBeNil)
+			So(lim.Allow(), ShouldBeTrue)
+			So(lim.Allow(), ShouldBeTrue)
+			So(lim.Allow(), ShouldBeFalse)
+		})
+
+		Convey("SetBurst changes how many tokens can accumulate", func() {
+			lim := NewBucketRateLimiter(1000.0)
+			lim.SetBurst(10)
+			So(lim.Capacity(), ShouldEqual, 10)
+
+			time.Sleep(time.Millisecond * 30)
+			So(lim.Available(), ShouldEqual, 10)
+
+			lim.SetBurst(3)
+			So(lim.Available(), ShouldEqual, 3)
+		})
+
+		Convey("Available reports no limit for a zero rate", func() {
+			lim := multilimiter.NewRateLimiter(0)
+			So(lim.Available(), ShouldEqual, math.MaxInt64)
+		})
+
+		Convey("Wait reports why it gave up", func() {
+			lim := multilimiter.NewRateLimiter(1.0)
+			lim.Reserve(2)
+
+			ctx, cancel := ContextWithCancel(0)
+			go func() {
+				time.Sleep(time.Millisecond * 20)
+				cancel()
+			}()
+			err := lim.Wait(ctx)
+
+			var waitErr *multilimiter.WaitError
+			So(errors.As(err, &waitErr), ShouldBeTrue)
+			So(waitErr.Stage, ShouldEqual, multilimiter.StageRate)
+			So(waitErr.Waited, ShouldBeGreaterThanOrEqualTo, time.Millisecond*20)
+			So(err, ShouldMatchError, context.Canceled)
+			So(err, ShouldMatchError, multilimiter.DeadlineExceeded)
 		})
 
 		Convey("Wait allows a 0 timeout in the context", func() {
@@ -64,6 +357,77 @@ func TestRateLimiterSpec(t *testing.T) {
 			So(err, ShouldBeNil)
 		})
 
+		Convey("Fairness", func() {
+			// a is queued behind a large reservation that is then canceled, letting b book an earlier time than a
+			// returns when a's tokens are ready, a channel closed once a finishes waiting and b
+			queueBehindCanceled := func(lim multilimiter.RateLimiter) (time.Time, <-chan struct{}, multilimiter.Reservation) {
+				lim.WaitN(Context(time.Second), 2)
+				ahead := lim.Reserve(30)
+				a := lim.Reserve(1)
+				aReady := time.Now().Add(a.Delay())
+				aDone := make(chan struct{})
+				go func() {
+					a.Wait(Context(time.Second))
+					close(aDone)
+				}()
+				time.Sleep(time.Millisecond * 10)
+
+				ahead.Cancel()
+				return aReady, aDone, lim.Reserve(1)
+			}
+
+			Convey("FIFO serves waiters in the order they reserved", func() {
+				lim := multilimiter.NewRateLimiter(100.0, &multilimiter.FairnessOption{Fairness: multilimiter.FairnessFIFO})
+				defer lim.Cancel()
+				aReady, aDone, b := queueBehindCanceled(lim)
+
+				// b's tokens are ready first but it still waits its turn behind a
+				So(b.Delay(), ShouldBeLessThan, time.Until(aReady))
+				So(b.Wait(Context(time.Second)), ShouldBeNil)
+				So(time.Now(), ShouldHappenOnOrAfter, aReady)
+				<-aDone
+			})
+
+			Convey("FairnessNone lets later waiters finish first", func() {
+				lim := multilimiter.NewRateLimiter(100.0)
+				defer lim.Cancel()
+				aReady, aDone, b := queueBehindCanceled(lim)
+
+				So(b.Delay(), ShouldBeLessThan, time.Until(aReady))
+				So(b.Wait(Context(time.Second)), ShouldBeNil)
+				select {
+				case <-aDone:
+					So("a finished before b", ShouldBeEmpty)
+				default:
+				}
+				<-aDone
+			})
+
+			Convey("FIFO keeps the p99 lateness low under contention", func() {
+				lim := multilimiter.NewRateLimiter(200.0, &multilimiter.BurstOption{Capacity: 1}, &multilimiter.FairnessOption{Fairness: multilimiter.FairnessFIFO})
+				defer lim.Cancel()
+				lim.Wait(Context(time.Second))
+
+				started := time.Now()
+				lateness := make([]time.Duration, 40)
+				var wg sync.WaitGroup
+				for i := range lateness {
+					wg.Add(1)
+					reservation := lim.Reserve(1)
+					go func(i int) {
+						defer wg.Done()
+						reservation.Wait(Context(time.Second))
+						ideal := time.Duration(i+1) * time.Millisecond * 5
+						lateness[i] = time.Since(started) - ideal
+					}(i)
+				}
+				wg.Wait()
+
+				// the bound is loose so that a slow machine doesn't fail the test
+				So(Percentile(lateness, 99), ShouldBeLessThan, time.Millisecond*50)
+			})
+		})
+
 		Convey("Rate returns the original input parameter", func() {
 			rate := 11.0
 			lim := multilimiter.NewRateLimiter(rate)
@@ -0,0 +1,254 @@
+package multilimiter
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// Tokens promised by RateLimiter.Reserve()
+// The tokens are taken when the reservation is made; Cancel() gives them back
+type Reservation interface {
+	// False if the tokens can never be provided, e.g. the limiter has been stopped
+	OK() bool
+	// How long to wait before the reserved tokens may be used
+	Delay() time.Duration
+	// Wait out the delay
+	// The reservation is canceled if ctx or the limiter finishes first
+	// only errors matching DeadlineExceeded and LimiterStopped can be returned
+	Wait(ctx context.Context) error
+	// Return the reserved tokens to the limiter
+	// Only call this if the tokens will not be used; calling it more than once has no effect
+	Cancel()
+}
+
+// A reservation against a tokenBucket
+type bucketReservation struct {
+	bucket *tokenBucket
+	tokens int64
+	done   <-chan struct{}
+	once   sync.Once
+	mu     sync.Mutex
+	// when the tokens can be used given the bucket's rate at the time
+	timeToAct time.Time
+	rate      float64
+	// set under FIFO so that waiters are served in the order they reserved
+	queue *fifoQueue
+	seq   uint64
+}
+
+var _ Reservation = (*bucketReservation)(nil)
+
+func (me *bucketReservation) OK() bool {
+	return true
+}
+
+func (me *bucketReservation) Delay() time.Duration {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+
+	if d := time.Until(me.timeToAct); d > 0 {
+		return d
+	}
+	return 0
+}
+
+// Waits out the delay, rescheduling whenever the bucket's rate changes
+// Under FIFO it first waits for every earlier reservation to finish waiting
+func (me *bucketReservation) Wait(ctx context.Context) error {
+	started := time.Now()
+	if me.queue != nil {
+		turn := me.queue.enter(me.seq)
+		defer me.queue.leave(turn)
+		if err := me.awaitTurn(ctx, turn, started); err != nil {
+			me.Cancel()
+			return err
+		}
+	}
+
+	for {
+		rate, changed := me.bucket.currentRate()
+
+		me.mu.Lock()
+		if rate != me.rate {
+			me.timeToAct, me.rate = me.bucket.reschedule(time.Now(), me.timeToAct, me.rate)
+		}
+		timeToAct := me.timeToAct
+		me.mu.Unlock()
+
+		err := waitUntil(ctx, timeToAct, me.done, changed)
+		if err == errWoken {
+			continue
+		}
+		if err != nil {
+			if waitErr, ok := err.(*WaitError); ok {
+				waitErr.Waited = time.Since(started)
+			}
+			me.Cancel()
+		}
+		return err
+	}
+}
+
+// Waits until every earlier reservation has finished waiting
+func (me *bucketReservation) awaitTurn(ctx context.Context, turn *list.Element, started time.Time) error {
+	me.mu.Lock()
+	timeToAct := me.timeToAct
+	me.mu.Unlock()
+	if deadline, ok := ctx.Deadline(); ok && deadline.Before(timeToAct) {
+		return newWaitError(StageRate, started, context.DeadlineExceeded)
+	}
+
+	select {
+	case <-turn.Value.(*fifoTurn).ready:
+		return nil
+	case <-me.done:
+		return newWaitError(StageRate, started, LimiterStopped)
+	case <-ctx.Done():
+		return newWaitError(StageRate, started, ctx.Err())
+	}
+}
+
+func (me *bucketReservation) Cancel() {
+	me.once.Do(func() {
+		me.bucket.refund(time.Now(), me.tokens)
+	})
+}
+
+// A reservation that can be used immediately
+type immediateReservation struct{}
+
+var _ Reservation = immediateReservation{}
+
+func (me immediateReservation) OK() bool                       { return true }
+func (me immediateReservation) Delay() time.Duration           { return 0 }
+func (me immediateReservation) Wait(ctx context.Context) error { return nil }
+func (me immediateReservation) Cancel()                        {}
+
+// A reservation made against a stopped limiter
+type stoppedReservation struct{}
+
+var _ Reservation = stoppedReservation{}
+
+func (me stoppedReservation) OK() bool                       { return false }
+func (me stoppedReservation) Delay() time.Duration           { return 0 }
+func (me stoppedReservation) Wait(ctx context.Context) error { return LimiterStopped }
+func (me stoppedReservation) Cancel()                        {}
+
+// A reservation for more tokens than the limiter can ever provide
+type oversizedReservation struct{}
+
+var _ Reservation = oversizedReservation{}
+
+func (me oversizedReservation) OK() bool                       { return false }
+func (me oversizedReservation) Delay() time.Duration           { return 0 }
+func (me oversizedReservation) Wait(ctx context.Context) error { return WeightExceedsLimit }
+func (me oversizedReservation) Cancel()                        {}
+
+// Returned by waitUntil when the wake channel is closed
+var errWoken = errors.New("woken")
+
+// Sleeps until t unless ctx or done finish first
+// Fails straight away if ctx's deadline falls before t
+// errWoken is returned if wake is closed first
+func waitUntil(ctx context.Context, t time.Time, done, wake <-chan struct{}) error {
+	started := time.Now()
+	d := t.Sub(started)
+	if d <= 0 {
+		return nil
+	}
+	if deadline, ok := ctx.Deadline(); ok && deadline.Before(t) {
+		return newWaitError(StageRate, started, context.DeadlineExceeded)
+	}
+
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-done:
+		return newWaitError(StageRate, started, LimiterStopped)
+	case <-ctx.Done():
+		return newWaitError(StageRate, started, ctx.Err())
+	case <-wake:
+		return errWoken
+	case <-timer.C:
+		return nil
+	}
+}
+
+// Lets waiters through one at a time in the order their tickets were issued
+type fifoQueue struct {
+	mu      sync.Mutex
+	issued  uint64
+	waiters list.List
+}
+
+// A waiter's place in a fifoQueue
+type fifoTurn struct {
+	seq uint64
+	// closed once the waiter reaches the front of the queue
+	ready  chan struct{}
+	served bool
+}
+
+// Issues the next place in line
+// reserve is called before any other ticket can be issued so that tokens are booked in ticket order
+func (me *fifoQueue) ticket(reserve func()) uint64 {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	me.issued++
+	reserve()
+	return me.issued
+}
+
+// Queues the holder of ticket seq behind every waiter with an earlier ticket
+func (me *fifoQueue) enter(seq uint64) *list.Element {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+
+	// waiters usually arrive in ticket order so search from the back
+	turn := &fifoTurn{seq: seq, ready: make(chan struct{})}
+	var elem *list.Element
+	e := me.waiters.Back()
+	for e != nil && e.Value.(*fifoTurn).seq > seq {
+		e = e.Prev()
+	}
+	if e == nil {
+		elem = me.waiters.PushFront(turn)
+	} else {
+		elem = me.waiters.InsertAfter(turn, e)
+	}
+
+	me.serveFront()
+	return elem
+}
+
+// Removes a waiter letting the next one through
+func (me *fifoQueue) leave(elem *list.Element) {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+
+	me.waiters.Remove(elem)
+	me.serveFront()
+}
+
+// The number of waiters in line
+func (me *fifoQueue) len() int {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	return me.waiters.Len()
+}
+
+// must be called with mu held
+func (me *fifoQueue) serveFront() {
+	front := me.waiters.Front()
+	if front == nil {
+		return
+	}
+	if turn := front.Value.(*fifoTurn); !turn.served {
+		turn.served = true
+		close(turn.ready)
+	}
+}
@@ -0,0 +1,98 @@
+package multilimiter
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Tracks the functions a limiter is running so that shutdown can wait for them
+type taskGroup struct {
+	mu       sync.Mutex
+	running  int
+	finished int
+	// closed whenever nothing is running
+	idle chan struct{}
+}
+
+func newTaskGroup() *taskGroup {
+	idle := make(chan struct{})
+	close(idle)
+	return &taskGroup{idle: idle}
+}
+
+func (me *taskGroup) start() {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+
+	if me.running == 0 {
+		me.idle = make(chan struct{})
+	}
+	me.running++
+}
+
+func (me *taskGroup) done() {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+
+	me.running--
+	me.finished++
+	if me.running == 0 {
+		close(me.idle)
+	}
+}
+
+// Returns the number of running and finished tasks
+func (me *taskGroup) counts() (running, finished int) {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	return me.running, me.finished
+}
+
+// Returns a channel that is closed once nothing is running
+func (me *taskGroup) idleCh() <-chan struct{} {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	return me.idle
+}
+
+// A function being run by a limiter
+type taskRun struct {
+	slot       Slot
+	started    time.Time
+	outcome    atomic.Int32
+	classifier OutcomeClassifier
+	// the limiter that admitted the function; it and its parents are told how it went
+	limiter *BasicLimiter
+	cleanup []func()
+}
+
+// Releases the function's context and slot
+// The slot is told how long the function ran and whether it was dropped
+// and the rate limiters that listen for outcomes are told the function's outcome
+func (me *taskRun) finish(panicked bool, err error) {
+	for i := len(me.cleanup) - 1; i >= 0; i-- {
+		me.cleanup[i]()
+	}
+
+	// notify before releasing the slot so that observers never see more running than the limit
+	rtt := time.Since(me.started)
+	for lim := me.limiter; lim != nil; lim = lim.parent {
+		lim.observer.OnTaskEnd(rtt, panicked)
+	}
+
+	outcome := Outcome(me.outcome.Load())
+	switch {
+	case panicked:
+		outcome = OutcomeDropped
+	case outcome == OutcomeSuccess && err != nil && me.classifier != nil:
+		outcome = me.classifier(err)
+	}
+
+	me.slot.ReleaseWithResult(rtt, outcome != OutcomeSuccess)
+	for lim := me.limiter; lim != nil; lim = lim.parent {
+		if listener, ok := lim.rateLimiter.(OutcomeListener); ok {
+			listener.OnOutcome(outcome)
+		}
+	}
+}
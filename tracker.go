@@ -6,7 +6,12 @@ import (
 	"time"
 )
 
+var _ Observer = (*ConcurrencyTracker)(nil)
+
+// Counts how many functions are running, how many have run and the most that ran at once
+// Register it with ObserverOption to have the limiter do the counting, or call Add() and Subtract() directly
 type ConcurrencyTracker struct {
+	NoopObserver
 	current int32
 	total   int32
 	max     int32
@@ -44,6 +49,14 @@ func (me *ConcurrencyTracker) Subtract() {
 	me.locker.Unlock()
 }
 
+func (me *ConcurrencyTracker) OnTaskStart() {
+	me.Add()
+}
+
+func (me *ConcurrencyTracker) OnTaskEnd(duration time.Duration, panicked bool) {
+	me.Subtract()
+}
+
 func (me *ConcurrencyTracker) Current() int32 {
 	return atomic.LoadInt32(&me.current)
 }
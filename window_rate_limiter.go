@@ -0,0 +1,426 @@
+package multilimiter
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+)
+
+// Decides when tokens can be used under a window based rate limit
+// Implementations are not safe for concurrent use; windowRateLimiter serializes calls
+type windowScheduler interface {
+	// Books tokens and returns when they can be used along with a func that gives them back
+	book(now time.Time, tokens int64) (time.Time, func(now time.Time))
+	// The number of tokens that can be booked for use right now
+	available(now time.Time) int64
+}
+
+// The RateLimiter behaviour shared by the window based rate limiters
+// A limit < 1 or a window <= 0 means no limit
+type windowRateLimiter struct {
+	limit     int64
+	window    time.Duration
+	canceler  *Canceler
+	mu        sync.Mutex
+	scheduler windowScheduler
+}
+
+func newWindowRateLimiter(limit int64, window time.Duration, scheduler windowScheduler) windowRateLimiter {
+	return windowRateLimiter{limit: limit, window: window, canceler: NewCanceler(), scheduler: scheduler}
+}
+
+func (me *windowRateLimiter) Wait(ctx context.Context) error {
+	return me.WaitN(ctx, 1)
+}
+
+// Wait until tokens resources are available
+// if tokens is < 1 nothing is taken and no waiting occurs
+// WeightExceedsLimit is returned if tokens is more than the limit
+func (me *windowRateLimiter) WaitN(ctx context.Context, tokens int64) error {
+	if me.canceler.IsCanceled() {
+		return LimiterStopped
+	}
+	if tokens < 1 {
+		return nil
+	}
+
+	return me.Reserve(tokens).Wait(ctx)
+}
+
+// Take a token only if one is available right now
+// Returns false if the limiter is canceled
+func (me *windowRateLimiter) Allow() bool {
+	if me.canceler.IsCanceled() {
+		return false
+	}
+
+	reservation := me.Reserve(1)
+	if reservation.Delay() > 0 {
+		reservation.Cancel()
+		return false
+	}
+	return true
+}
+
+// Take tokens now and report how long to wait before using them
+// Requests for more than the limit can never fit in a window so they are not OK
+// and waiting on them fails with WeightExceedsLimit
+// Canceling the Reservation returns the tokens to the windows that have not yet passed
+func (me *windowRateLimiter) Reserve(tokens int64) Reservation {
+	if me.canceler.IsCanceled() {
+		return stoppedReservation{}
+	}
+	if tokens < 1 || me.unlimited() {
+		return immediateReservation{}
+	}
+	if tokens > me.limit {
+		return oversizedReservation{}
+	}
+
+	me.mu.Lock()
+	timeToAct, refund := me.scheduler.book(time.Now(), tokens)
+	me.mu.Unlock()
+
+	return &windowReservation{
+		timeToAct: timeToAct,
+		done:      me.canceler.Done(),
+		refund: func() {
+			me.mu.Lock()
+			defer me.mu.Unlock()
+			refund(time.Now())
+		},
+	}
+}
+
+// The average rate permitted per second
+func (me *windowRateLimiter) Rate() float64 {
+	if me.unlimited() {
+		return 0
+	}
+	return float64(me.limit) / me.window.Seconds()
+}
+
+// The number of tokens allowed per window
+func (me *windowRateLimiter) Limit() int64 {
+	return me.limit
+}
+
+func (me *windowRateLimiter) Window() time.Duration {
+	return me.window
+}
+
+func (me *windowRateLimiter) Available() int64 {
+	if me.unlimited() {
+		return math.MaxInt64
+	}
+
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	return me.scheduler.available(time.Now())
+}
+
+func (me *windowRateLimiter) Cancel() {
+	me.canceler.Cancel()
+}
+
+func (me *windowRateLimiter) unlimited() bool {
+	return me.limit < 1 || me.window <= 0
+}
+
+// A reservation against a window based rate limiter
+type windowReservation struct {
+	timeToAct time.Time
+	done      <-chan struct{}
+	refund    func()
+	once      sync.Once
+}
+
+var _ Reservation = (*windowReservation)(nil)
+
+func (me *windowReservation) OK() bool {
+	return true
+}
+
+func (me *windowReservation) Delay() time.Duration {
+	if d := time.Until(me.timeToAct); d > 0 {
+		return d
+	}
+	return 0
+}
+
+func (me *windowReservation) Wait(ctx context.Context) error {
+	err := waitUntil(ctx, me.timeToAct, me.done, nil)
+	if err != nil {
+		me.Cancel()
+	}
+	return err
+}
+
+func (me *windowReservation) Cancel() {
+	me.once.Do(me.refund)
+}
+
+// Allows limit tokens in each window aligned to the epoch, e.g. per calendar minute
+// The whole limit can be used at the very end of one window and again at the start of the next
+type FixedWindowRateLimiter struct {
+	windowRateLimiter
+}
+
+var _ RateLimiter = (*FixedWindowRateLimiter)(nil)
+
+func NewFixedWindowRateLimiter(limit int64, window time.Duration) *FixedWindowRateLimiter {
+	scheduler := &fixedWindow{limit: limit, window: window, booked: map[int64]int64{}}
+	return &FixedWindowRateLimiter{newWindowRateLimiter(limit, window, scheduler)}
+}
+
+type fixedWindow struct {
+	limit  int64
+	window time.Duration
+	// tokens booked into each window keyed by the window's index since the epoch
+	booked map[int64]int64
+}
+
+func (me *fixedWindow) book(now time.Time, tokens int64) (time.Time, func(time.Time)) {
+	me.prune(now)
+
+	timeToAct := now
+	taken := map[int64]int64{}
+	for i := windowIndex(now, me.window); tokens > 0; i++ {
+		free := me.limit - me.booked[i]
+		if free <= 0 {
+			continue
+		}
+
+		n := min(free, tokens)
+		me.booked[i] += n
+		taken[i] = n
+		tokens -= n
+		if start := windowStart(i, me.window); start.After(timeToAct) {
+			timeToAct = start
+		}
+	}
+
+	return timeToAct, func(now time.Time) {
+		me.prune(now)
+		for i, n := range taken {
+			if _, ok := me.booked[i]; ok {
+				me.booked[i] -= n
+			}
+		}
+	}
+}
+
+func (me *fixedWindow) available(now time.Time) int64 {
+	me.prune(now)
+	return me.limit - me.booked[windowIndex(now, me.window)]
+}
+
+// Forgets windows that have passed
+func (me *fixedWindow) prune(now time.Time) {
+	current := windowIndex(now, me.window)
+	for i := range me.booked {
+		if i < current {
+			delete(me.booked, i)
+		}
+	}
+}
+
+// Allows limit tokens in any period of length window by remembering when each token was used
+// This is exact but keeps a timestamp for every token used within the last window
+// Tokens are handed out in the order they are reserved
+type SlidingWindowLogRateLimiter struct {
+	windowRateLimiter
+}
+
+var _ RateLimiter = (*SlidingWindowLogRateLimiter)(nil)
+
+func NewSlidingWindowLogRateLimiter(limit int64, window time.Duration) *SlidingWindowLogRateLimiter {
+	scheduler := &slidingLog{limit: limit, window: window}
+	return &SlidingWindowLogRateLimiter{newWindowRateLimiter(limit, window, scheduler)}
+}
+
+type slidingLog struct {
+	limit  int64
+	window time.Duration
+	// when each token within the last window was or will be used, oldest first
+	log []time.Time
+}
+
+func (me *slidingLog) book(now time.Time, tokens int64) (time.Time, func(time.Time)) {
+	me.prune(now)
+
+	t := now
+	taken := make([]time.Time, 0, tokens)
+	for k := int64(0); k < tokens; k++ {
+		n := int64(len(me.log))
+		// never schedule ahead of a token that has already been reserved
+		if n > 0 && me.log[n-1].After(t) {
+			t = me.log[n-1]
+		}
+		// the token must wait until the limit-th most recent token leaves the window
+		if n >= me.limit {
+			if next := me.log[n-me.limit].Add(me.window); next.After(t) {
+				t = next
+			}
+		}
+		me.log = append(me.log, t)
+		taken = append(taken, t)
+	}
+
+	return t, func(now time.Time) {
+		me.prune(now)
+		for _, t := range taken {
+			me.remove(t)
+		}
+	}
+}
+
+func (me *slidingLog) available(now time.Time) int64 {
+	me.prune(now)
+	return me.limit - int64(len(me.log))
+}
+
+// Forgets tokens that have left the window
+func (me *slidingLog) prune(now time.Time) {
+	cutoff := now.Add(-me.window)
+	i := 0
+	for i < len(me.log) && !me.log[i].After(cutoff) {
+		i++
+	}
+	me.log = me.log[i:]
+}
+
+// Removes the latest entry at t if it is still in the log
+func (me *slidingLog) remove(t time.Time) {
+	for i := len(me.log) - 1; i >= 0; i-- {
+		if me.log[i].Equal(t) {
+			me.log = append(me.log[:i], me.log[i+1:]...)
+			return
+		}
+	}
+}
+
+// Approximates a sliding window by weighting the previous fixed window's count
+// by how much of it still overlaps the sliding window
+// This only keeps two counters but may allow slightly more or less than the limit
+// Tokens are handed out in the order they are reserved
+type SlidingWindowCounterRateLimiter struct {
+	windowRateLimiter
+}
+
+var _ RateLimiter = (*SlidingWindowCounterRateLimiter)(nil)
+
+func NewSlidingWindowCounterRateLimiter(limit int64, window time.Duration) *SlidingWindowCounterRateLimiter {
+	scheduler := &slidingCounter{limit: limit, window: window, counts: map[int64]int64{}}
+	return &SlidingWindowCounterRateLimiter{newWindowRateLimiter(limit, window, scheduler)}
+}
+
+type slidingCounter struct {
+	limit  int64
+	window time.Duration
+	// tokens counted in each fixed window keyed by the window's index since the epoch
+	counts map[int64]int64
+	// when each reservation that can't be used yet can be used, oldest first
+	pending []time.Time
+}
+
+func (me *slidingCounter) book(now time.Time, tokens int64) (time.Time, func(time.Time)) {
+	me.prune(now)
+
+	// never schedule ahead of tokens that have already been reserved
+	t := now
+	if n := len(me.pending); n > 0 && me.pending[n-1].After(t) {
+		t = me.pending[n-1]
+	}
+
+	i, t := me.schedule(t, tokens)
+	me.counts[i] += tokens
+	me.pending = append(me.pending, t)
+
+	return t, func(now time.Time) {
+		me.prune(now)
+		if _, ok := me.counts[i]; ok {
+			me.counts[i] -= tokens
+		}
+		me.unblock(t)
+	}
+}
+
+// Removes the latest pending reservation at t so that later ones aren't held behind it
+func (me *slidingCounter) unblock(t time.Time) {
+	for i := len(me.pending) - 1; i >= 0; i-- {
+		if me.pending[i].Equal(t) {
+			me.pending = append(me.pending[:i], me.pending[i+1:]...)
+			return
+		}
+	}
+}
+
+// Finds the first window at or after t in which tokens fit and when they can be used
+func (me *slidingCounter) schedule(t time.Time, tokens int64) (int64, time.Time) {
+	for i := windowIndex(t, me.window); ; i++ {
+		if me.counts[i]+tokens > me.limit {
+			continue
+		}
+
+		at := me.earliest(i, tokens)
+		if at.Before(t) {
+			at = t
+		}
+		if at.Before(windowStart(i+1, me.window)) {
+			return i, at
+		}
+	}
+}
+
+// When tokens fit within window i once enough of the previous window has slid out
+func (me *slidingCounter) earliest(i int64, tokens int64) time.Time {
+	start := windowStart(i, me.window)
+	prev := float64(me.counts[i-1])
+	if prev == 0 {
+		return start
+	}
+
+	// prev * (1 - elapsed/window) + count + tokens <= limit
+	free := float64(me.limit - me.counts[i] - tokens)
+	elapsed := 1 - free/prev
+	if elapsed <= 0 {
+		return start
+	}
+	return start.Add(time.Duration(math.Ceil(elapsed * float64(me.window))))
+}
+
+func (me *slidingCounter) available(now time.Time) int64 {
+	me.prune(now)
+
+	i := windowIndex(now, me.window)
+	elapsed := float64(now.Sub(windowStart(i, me.window))) / float64(me.window)
+	estimate := float64(me.counts[i-1])*(1-elapsed) + float64(me.counts[i])
+	return me.limit - int64(math.Ceil(estimate))
+}
+
+// Forgets windows that no longer overlap the sliding window and reservations that can be used
+func (me *slidingCounter) prune(now time.Time) {
+	previous := windowIndex(now, me.window) - 1
+	for i := range me.counts {
+		if i < previous {
+			delete(me.counts, i)
+		}
+	}
+
+	i := 0
+	for i < len(me.pending) && !me.pending[i].After(now) {
+		i++
+	}
+	me.pending = me.pending[i:]
+}
+
+// The index since the epoch of the fixed window containing t
+func windowIndex(t time.Time, window time.Duration) int64 {
+	return t.UnixNano() / int64(window)
+}
+
+func windowStart(i int64, window time.Duration) time.Time {
+	return time.Unix(0, i*int64(window))
+}
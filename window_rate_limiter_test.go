@@ -0,0 +1,212 @@
+package multilimiter_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/jrboelens/multilimiter"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestWindowRateLimiterSpec(t *testing.T) {
+
+	window := time.Millisecond * 100
+
+	Convey("Window rate limiter tests ", t, func() {
+
+		Convey("FixedWindowRateLimiter", func() {
+			lim := multilimiter.NewFixedWindowRateLimiter(3, window)
+			defer lim.Cancel()
+
+			Convey("allows the limit within a window", func() {
+				SleepUntilWindowStarts(window, time.Millisecond*5)
+				for i := 0; i < 3; i++ {
+					So(lim.Allow(), ShouldBeTrue)
+				}
+				So(lim.Allow(), ShouldBeFalse)
+				So(lim.Available(), ShouldEqual, 0)
+			})
+
+			Convey("makes callers wait for the next window to start", func() {
+				SleepUntilWindowStarts(window, time.Millisecond*5)
+				So(lim.WaitN(Context(time.Millisecond*20), 3), ShouldBeNil)
+
+				reservation := lim.Reserve(1)
+				So(reservation.Delay(), ShouldBeBetween, time.Millisecond*50, window)
+				So(reservation.Wait(Context(time.Second)), ShouldBeNil)
+				So(lim.Available(), ShouldEqual, 2)
+			})
+
+			Convey("allows the limit again as soon as a window ends", func() {
+				SleepUntilWindowStarts(window, window-time.Millisecond*15)
+				So(lim.WaitN(Context(time.Millisecond*5), 3), ShouldBeNil)
+
+				SleepUntilWindowStarts(window, time.Millisecond)
+				So(lim.WaitN(Context(time.Millisecond*5), 3), ShouldBeNil)
+			})
+
+			Convey("spreads a request over the next window when the current one is partly used", func() {
+				SleepUntilWindowStarts(window, time.Millisecond*5)
+				So(lim.WaitN(Context(time.Millisecond*5), 2), ShouldBeNil)
+
+				reservation := lim.Reserve(3)
+				So(reservation.Delay(), ShouldBeBetween, time.Millisecond*50, window)
+				reservation.Cancel()
+				So(lim.Available(), ShouldEqual, 1)
+			})
+		})
+
+		Convey("SlidingWindowLogRateLimiter", func() {
+			lim := multilimiter.NewSlidingWindowLogRateLimiter(3, window)
+			defer lim.Cancel()
+
+			Convey("does not reset at fixed window boundaries", func() {
+				SleepUntilWindowStarts(window, window-time.Millisecond*15)
+				So(lim.WaitN(Context(time.Millisecond*5), 3), ShouldBeNil)
+
+				SleepUntilWindowStarts(window, time.Millisecond)
+				So(lim.Allow(), ShouldBeFalse)
+			})
+
+			Convey("frees each token a window after it was used", func() {
+				So(lim.Allow(), ShouldBeTrue)
+				time.Sleep(time.Millisecond * 40)
+				So(lim.WaitN(Context(time.Millisecond*5), 2), ShouldBeNil)
+
+				reservation := lim.Reserve(1)
+				So(reservation.Delay(), ShouldBeBetween, time.Millisecond*30, time.Millisecond*61)
+				So(reservation.Wait(Context(time.Second)), ShouldBeNil)
+
+				// the two tokens taken after the sleep are still within the window
+				So(lim.Allow(), ShouldBeFalse)
+			})
+
+			Convey("returns canceled tokens", func() {
+				So(lim.WaitN(Context(time.Millisecond*5), 3), ShouldBeNil)
+				reservation := lim.Reserve(2)
+				So(lim.Available(), ShouldEqual, -2)
+
+				reservation.Cancel()
+				So(lim.Available(), ShouldEqual, 0)
+			})
+		})
+
+		Convey("SlidingWindowCounterRateLimiter", func() {
+			lim := multilimiter.NewSlidingWindowCounterRateLimiter(10, window)
+			defer lim.Cancel()
+
+			Convey("weights the previous window by how much of it overlaps", func() {
+				SleepUntilWindowStarts(window, window-time.Millisecond*15)
+				So(lim.WaitN(Context(time.Millisecond*5), 10), ShouldBeNil)
+
+				SleepUntilWindowStarts(window, time.Millisecond*50)
+				So(lim.Available(), ShouldBeBetweenOrEqual, 3, 6)
+			})
+
+			Convey("makes callers wait until enough of the previous window has slid out", func() {
+				SleepUntilWindowStarts(window, window-time.Millisecond*15)
+				So(lim.WaitN(Context(time.Millisecond*5), 10), ShouldBeNil)
+
+				SleepUntilWindowStarts(window, time.Millisecond)
+				reservation := lim.Reserve(5)
+				So(reservation.Delay(), ShouldBeBetween, time.Millisecond*40, time.Millisecond*55)
+				reservation.Cancel()
+			})
+
+			Convey("returns canceled tokens", func() {
+				SleepUntilWindowStarts(window, time.Millisecond*5)
+				reservation := lim.Reserve(4)
+				So(lim.Available(), ShouldEqual, 6)
+
+				reservation.Cancel()
+				So(lim.Available(), ShouldEqual, 10)
+			})
+
+			Convey("does not hold later callers behind a canceled reservation", func() {
+				lim := multilimiter.NewSlidingWindowCounterRateLimiter(10, time.Minute)
+				defer lim.Cancel()
+
+				So(lim.WaitN(Context(time.Millisecond*5), 8), ShouldBeNil)
+				reservation := lim.Reserve(5)
+				So(reservation.Delay(), ShouldBeGreaterThan, time.Second)
+
+				reservation.Cancel()
+				So(lim.Available(), ShouldEqual, 2)
+				So(lim.Reserve(1).Delay(), ShouldEqual, 0)
+				So(lim.Allow(), ShouldBeTrue)
+			})
+		})
+
+		Convey("window rate limiters", func() {
+			cases := []struct {
+				name string
+				lim  multilimiter.RateLimiter
+			}{
+				{"fixed", multilimiter.NewFixedWindowRateLimiter(2, time.Minute)},
+				{"log", multilimiter.NewSlidingWindowLogRateLimiter(2, time.Minute)},
+				{"counter", multilimiter.NewSlidingWindowCounterRateLimiter(2, time.Minute)},
+			}
+
+			for _, c := range cases {
+				name, lim := c.name, c.lim
+
+				Convey(name+" can be cancelled", func() {
+					lim.Cancel()
+					So(lim.Wait(Context(time.Second)), ShouldMatchError, multilimiter.LimiterStopped)
+					So(lim.Allow(), ShouldBeFalse)
+				})
+
+				Convey(name+" adheres to a timeout", func() {
+					defer lim.Cancel()
+
+					So(lim.WaitN(Context(time.Millisecond*20), 2), ShouldBeNil)
+					So(lim.Wait(Context(time.Millisecond*20)), ShouldMatchError, multilimiter.DeadlineExceeded)
+					So(lim.Available(), ShouldEqual, 0)
+				})
+
+				Convey(name+" rejects requests for more than the limit", func() {
+					defer lim.Cancel()
+
+					reservation := lim.Reserve(3)
+					So(reservation.OK(), ShouldBeFalse)
+					So(reservation.Wait(Context(time.Second)), ShouldEqual, multilimiter.WeightExceedsLimit)
+					So(lim.WaitN(Context(time.Second), 3), ShouldEqual, multilimiter.WeightExceedsLimit)
+					So(lim.Available(), ShouldEqual, 2)
+				})
+
+				Convey(name+" lets callers through once a delayed reservation is canceled", func() {
+					defer lim.Cancel()
+
+					So(lim.Allow(), ShouldBeTrue)
+					reservation := lim.Reserve(2)
+					So(reservation.Delay(), ShouldBeGreaterThan, 0)
+
+					reservation.Cancel()
+					So(lim.Reserve(1).Delay(), ShouldEqual, 0)
+					So(lim.Allow(), ShouldBeFalse)
+				})
+
+				Convey(name+" plugs in through RateLimitOption", func() {
+					limiter := multilimiter.NewLimiter(
+						&multilimiter.RateLimitOption{Limiter: lim},
+						&multilimiter.ConcLimitOption{Limiter: multilimiter.NewConcLimiter(2)},
+					)
+					defer limiter.Stop()
+
+					doNothing := func(context.Context) error { return nil }
+					So(limiter.Do(Context(time.Second), doNothing), ShouldBeNil)
+					So(limiter.Do(Context(time.Second), doNothing), ShouldBeNil)
+					So(limiter.Do(Context(time.Millisecond*20), doNothing), ShouldMatchError, multilimiter.DeadlineExceeded)
+					So(limiter.ExecuteN(Context(time.Second), 3, 1, func(context.Context) {}), ShouldEqual, multilimiter.WeightExceedsLimit)
+				})
+			}
+		})
+	})
+}
+
+// Sleeps until offset into the next window aligned to the epoch
+func SleepUntilWindowStarts(window, offset time.Duration) {
+	next := (time.Now().UnixNano()/int64(window) + 1) * int64(window)
+	time.Sleep(time.Until(time.Unix(0, next)) + offset)
+}